@@ -5,12 +5,28 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/stealthrocket/fsinfo"
-	"github.com/stealthrocket/fslink"
 )
 
-// Archive archives a file system into a tarball.
+// Prefix of the PAX records holding extended attributes.
+const paxXattr = "SCHILY.xattr."
+
+// Archive writes the entries of the file system fsys to tarball.
+//
+// The ownership, device numbers and extended attributes of the entries are
+// preserved when archiving file systems opened by this package. For file
+// systems backed by the OS, ownership is read from the fs.FileInfo values,
+// with user and group names looked up from their ids, and device numbers are
+// captured on Linux and macOS. Extended attributes are read on Linux, for the
+// regular files and directories which are opened as *os.File values (e.g. with
+// os.DirFS). Extended attributes are recorded as SCHILY.xattr PAX records.
 //
 // If the file system contains symbolic links, it must implement a ReadLink
 // method with this signature to allow reading the value of the link targets:
@@ -19,16 +35,82 @@ import (
 //		ReadLink(name string) (string, error)
 //	}
 //
-// See https://github.com/golang/go/issues/49580 for details about the expected
+// When built with Go 1.25 or later, file systems implementing the standard
+// fs.ReadLinkFS interface (e.g. os.DirFS) are preferred, and may have symbolic
+// links with absolute targets. Otherwise, see
+// https://github.com/golang/go/issues/49580 for details about the expected
 // behavior of the ReadLinkFS interface.
-func Archive(tarball *tar.Writer, fsys fs.FS) error {
+//
+// The Exclude and Filter options select the entries which are archived, the
+// NamePrefix, StripComponents, Rename and MapNames options change their names
+// in the tarball, and the Reproducible option can be used to write tarballs
+// which only depend on the content of the file system. ImplicitDirMode and
+// ImplicitDirModTime set the metadata of the parent directories added for
+// renamed entries, the other options do not apply. ListArchive returns the
+// names of the entries that Archive would write.
+//
+// Regular files are archived with their full content, including the holes of
+// sparse files, since the archive/tar package cannot write sparse entries. Use
+// WriteArchive to archive sparse files efficiently.
+func Archive(tarball *tar.Writer, fsys fs.FS, options ...Option) error {
+	return archive(tarball, fsys, newConfig(options))
+}
+
+// WriteArchive writes a complete tarball of fsys to w, including its
+// end-of-archive marker, like Archive with the same options.
+//
+// Regular files with holes of at least 4 KiB are written as sparse entries of
+// the GNU PAX format 1.0, which only contain the data of the files, and are
+// expanded when the tarball is read by this package, the archive/tar package,
+// and most tar implementations (e.g. GNU tar or bsdtar). The holes of files
+// opened as *os.File values (e.g. with os.DirFS) are found with SEEK_DATA and
+// SEEK_HOLE on Linux and macOS, and the holes of files of file systems opened
+// by this package are those of their entries. The holes of other files are
+// found by searching their content for blocks of zeros as they are read, which
+// requires holding their data in memory, or in a temporary file when they are
+// larger than 1 MiB, until the header of the entry is written. With the
+// Reproducible option, the holes are always found from the content of files so
+// that the tarball does not depend on how the file system allocated blocks.
+func WriteArchive(w io.Writer, fsys fs.FS, options ...Option) error {
+	tarball := &tarStream{w: w}
+	if err := archive(tarball, fsys, newConfig(options)); err != nil {
+		return err
+	}
+	return tarball.Close()
+}
+
+// tarWriter is the interface of the writers that archive writes entries to,
+// implemented by *tar.Writer and *tarStream.
+type tarWriter interface {
+	io.Writer
+	WriteHeader(*tar.Header) error
+}
+
+// archive writes the entries of fsys to tarball. Sparse files are written as
+// sparse entries if tarball is a *tarStream.
+func archive(tarball tarWriter, fsys fs.FS, config *config) error {
 	links := make(map[uint64]string)
+	owners := make(ownerNames)
 	buffer := make([]byte, 32*1024)
 
-	return fs.WalkDir(fsys, ".", func(path string, entry fs.DirEntry, err error) error {
-		if err != nil {
-			return err
+	return walkArchive(fsys, config, func(name, path string, entry fs.DirEntry) error {
+		if entry == nil {
+			h := tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     name,
+				Mode:     int64(config.implicitDirMode),
+				ModTime:  config.implicitDirModTime,
+				Format:   tar.FormatPAX,
+			}
+			if config.reproducible {
+				reproducibleHeader(&h, config.reproducibleModTime)
+			}
+			if err := tarball.WriteHeader(&h); err != nil {
+				return &fs.PathError{Op: "write", Path: name, Err: err}
+			}
+			return nil
 		}
+
 		info, err := entry.Info()
 		if err != nil {
 			return err
@@ -36,7 +118,7 @@ func Archive(tarball *tar.Writer, fsys fs.FS) error {
 		mode := info.Mode()
 
 		h := tar.Header{
-			Name:    path,
+			Name:    name,
 			Mode:    int64(fsinfo.Mode(info)),
 			ModTime: info.ModTime(),
 			Format:  tar.FormatPAX,
@@ -50,7 +132,7 @@ func Archive(tarball *tar.Writer, fsys fs.FS) error {
 			h.Typeflag = tar.TypeDir
 
 		case fs.ModeSymlink:
-			s, err := fslink.ReadLink(fsys, path)
+			s, err := readLink(fsys, path)
 			if err != nil {
 				return err
 			}
@@ -71,29 +153,59 @@ func Archive(tarball *tar.Writer, fsys fs.FS) error {
 		}
 
 		if !mode.IsDir() {
-			if nlink := fsinfo.Nlink(info); nlink > 1 {
-				if ino := fsinfo.Ino(info); ino != 0 {
-					if link, ok := links[ino]; ok {
-						h.Typeflag = tar.TypeLink
-						h.Linkname = link
-					} else {
-						links[ino] = path
-					}
+			if ino, nlink := Ino(info), Nlink(info); nlink > 1 && ino != 0 {
+				if link, ok := links[ino]; ok {
+					h.Typeflag = tar.TypeLink
+					h.Linkname = link
+				} else {
+					links[ino] = name
 				}
 			}
 		}
 
-		switch h.Typeflag {
-		case tar.TypeReg, tar.TypeChar, tar.TypeBlock:
+		if h.Typeflag == tar.TypeReg {
 			h.Size = info.Size()
 		}
 
+		// File systems opened by this package carry the metadata of entries
+		// in tar headers, other file systems may be backed by the OS.
+		device := h.Typeflag == tar.TypeChar || h.Typeflag == tar.TypeBlock
+		if sys := Header(info); sys != nil {
+			h.Uid, h.Gid, h.Uname, h.Gname = sys.Uid, sys.Gid, sys.Uname, sys.Gname
+			if device {
+				h.Devmajor, h.Devminor = sys.Devmajor, sys.Devminor
+			}
+			for key, value := range sys.PAXRecords {
+				if strings.HasPrefix(key, paxXattr) {
+					setPAXRecord(&h, key, value)
+				}
+			}
+		} else if hasStat(info) {
+			h.Uid, h.Gid = int(fsinfo.Uid(info)), int(fsinfo.Gid(info))
+			h.Uname, h.Gname = owners.user(h.Uid), owners.group(h.Gid)
+			if device {
+				h.Devmajor, h.Devminor = statDevice(info)
+			}
+			if mode.IsRegular() || mode.IsDir() {
+				if err := setXattrs(&h, fsys, path); err != nil {
+					return err
+				}
+			}
+		}
+
+		if config.reproducible {
+			reproducibleHeader(&h, config.reproducibleModTime)
+		}
+
+		if stream, ok := tarball.(*tarStream); ok && h.Typeflag == tar.TypeReg && h.Size >= minHoleSize {
+			return writeFile(stream, fsys, path, info, &h, config.reproducible, buffer)
+		}
+
 		if err := tarball.WriteHeader(&h); err != nil {
-			return &fs.PathError{"write", path, err}
+			return &fs.PathError{Op: "write", Path: path, Err: err}
 		}
 
-		switch h.Typeflag {
-		case tar.TypeReg, tar.TypeChar, tar.TypeBlock:
+		if h.Typeflag == tar.TypeReg {
 			file, err := fsys.Open(path)
 			if err != nil {
 				return err
@@ -105,10 +217,191 @@ func Archive(tarball *tar.Writer, fsys fs.FS) error {
 			}
 			if size := info.Size(); size != n {
 				err := fmt.Errorf("file size and number of bytes written mismatch: size=%d written=%d", size, n)
-				return &fs.PathError{"write", path, err}
+				return &fs.PathError{Op: "write", Path: path, Err: err}
 			}
 		}
 
 		return nil
 	})
 }
+
+// ListArchive returns the names of the entries that Archive would write to the
+// tarball when passed the same file system and options, in the same order,
+// without reading the content of files.
+func ListArchive(fsys fs.FS, options ...Option) ([]string, error) {
+	var names []string
+	err := walkArchive(fsys, newConfig(options), func(name, path string, entry fs.DirEntry) error {
+		names = append(names, name)
+		return nil
+	})
+	return names, err
+}
+
+// walkArchive calls fn with the name in the tarball, the path in fsys, and the
+// directory entry of the entries of fsys selected by the configuration. The
+// directories which are excluded are not read.
+//
+// Entries whose parent directory was not archived under the name of their
+// parent in the tarball, which happens when renaming entries, are preceded by
+// calls to fn with a nil entry for each of the missing directories.
+func walkArchive(fsys fs.FS, config *config, fn func(name, path string, entry fs.DirEntry) error) error {
+	filter, err := newArchiveFilter(config)
+	if err != nil {
+		return err
+	}
+	dirs := make(map[string]struct{})
+
+	var addParents func(string) error
+	addParents = func(name string) error {
+		if name == "." {
+			return nil
+		}
+		parent := path.Dir(name)
+		if _, ok := dirs[parent]; ok || parent == "." {
+			return nil
+		}
+		if err := addParents(parent); err != nil {
+			return err
+		}
+		dirs[parent] = struct{}{}
+		return fn(parent, "", nil)
+	}
+
+	return fs.WalkDir(fsys, ".", func(entryPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		switch entry.Type() {
+		case fs.ModeSocket, fs.ModeIrregular:
+			return nil // unsupported file types
+		}
+		if !filter.include(entryPath, entry) {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		name, err := archiveName(config, entryPath)
+		if err != nil {
+			return &fs.PathError{Op: "archive", Path: entryPath, Err: err}
+		}
+		if name == "" {
+			return nil
+		}
+		if err := addParents(name); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			dirs[name] = struct{}{}
+		}
+		return fn(name, entryPath, entry)
+	})
+}
+
+// archiveName returns the name in the tarball of the entry at name in the file
+// system, or an empty string if the entry must be skipped.
+func archiveName(config *config, name string) (string, error) {
+	for _, mapName := range config.nameMaps {
+		if name = mapName(name); name == "" {
+			return "", nil
+		}
+	}
+	name = path.Clean(name)
+	if !fs.ValidPath(name) {
+		return "", ErrUnsafePath
+	}
+	return name, nil
+}
+
+// reproducibleHeader normalizes the metadata of h which depends on when and
+// where the file system was created rather than on its content.
+func reproducibleHeader(h *tar.Header, modTime time.Time) {
+	if h.ModTime.IsZero() || h.ModTime.After(modTime) {
+		h.ModTime = modTime
+	}
+	// The precision of modification times differs between file systems.
+	h.ModTime = h.ModTime.Truncate(time.Second)
+	h.AccessTime, h.ChangeTime = time.Time{}, time.Time{}
+	h.Uid, h.Gid, h.Uname, h.Gname = 0, 0, "", ""
+	if h.Typeflag != tar.TypeChar && h.Typeflag != tar.TypeBlock {
+		h.Devmajor, h.Devminor = 0, 0
+	}
+	// Extended attributes are often set by the environment (e.g. SELinux
+	// labels or quarantine flags) rather than by the content of files.
+	for key := range h.PAXRecords {
+		if strings.HasPrefix(key, paxXattr) {
+			delete(h.PAXRecords, key)
+		}
+	}
+	if len(h.PAXRecords) == 0 {
+		h.PAXRecords = nil
+	}
+}
+
+// setXattrs records the extended attributes of the file at path as PAX records
+// of h. The attributes can only be read if opening the file returns an *os.File
+// (e.g. with os.DirFS).
+func setXattrs(h *tar.Header, fsys fs.FS, path string) error {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	file, ok := f.(*os.File)
+	if !ok {
+		return nil
+	}
+	xattrs, err := readXattrs(file.Name())
+	if err != nil {
+		return &fs.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+	for name, value := range xattrs {
+		setPAXRecord(h, paxXattr+name, value)
+	}
+	return nil
+}
+
+func setPAXRecord(h *tar.Header, key, value string) {
+	if h.PAXRecords == nil {
+		h.PAXRecords = make(map[string]string)
+	}
+	h.PAXRecords[key] = value
+}
+
+// ownerNames caches the names of users and groups looked up by id. Names that
+// cannot be found are cached as empty strings.
+type ownerNames map[ownerID]string
+
+type ownerID struct {
+	group bool
+	id    int
+}
+
+func (names ownerNames) user(uid int) string {
+	return names.lookup(ownerID{id: uid}, func(id string) (string, error) {
+		u, err := user.LookupId(id)
+		if err != nil {
+			return "", err
+		}
+		return u.Username, nil
+	})
+}
+
+func (names ownerNames) group(gid int) string {
+	return names.lookup(ownerID{group: true, id: gid}, func(id string) (string, error) {
+		g, err := user.LookupGroupId(id)
+		if err != nil {
+			return "", err
+		}
+		return g.Name, nil
+	})
+}
+
+func (names ownerNames) lookup(id ownerID, f func(string) (string, error)) string {
+	name, ok := names[id]
+	if !ok {
+		name, _ = f(strconv.Itoa(id.id))
+		names[id] = name
+	}
+	return name
+}
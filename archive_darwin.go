@@ -0,0 +1,28 @@
+package tarfs
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// Values of whence for lseek(2) seeking data and holes.
+const (
+	seekWhenceHole = 3
+	seekWhenceData = 4
+)
+
+// statDevice returns the device numbers of the device file described by info.
+func statDevice(info fs.FileInfo) (major, minor int64) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	dev := uint32(stat.Rdev)
+	return int64((dev >> 24) & 0xff), int64(dev & 0xffffff)
+}
+
+// readXattrs returns the extended attributes of the file at path, which are
+// not supported on this platform.
+func readXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
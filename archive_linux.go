@@ -0,0 +1,82 @@
+package tarfs
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"syscall"
+)
+
+// Values of whence for lseek(2) seeking data and holes.
+const (
+	seekWhenceData = 3
+	seekWhenceHole = 4
+)
+
+// statDevice returns the device numbers of the device file described by info.
+func statDevice(info fs.FileInfo) (major, minor int64) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	dev := uint64(stat.Rdev)
+	major = int64(((dev >> 8) & 0xfff) | ((dev >> 32) & 0xfffff000))
+	minor = int64((dev & 0xff) | ((dev >> 12) & 0xffffff00))
+	return major, minor
+}
+
+// readXattrs returns the extended attributes of the file at path, following
+// symbolic links.
+func readXattrs(path string) (map[string]string, error) {
+	names, err := xattrCall(func(b []byte) (int, error) {
+		return syscall.Listxattr(path, b)
+	})
+	if err != nil {
+		if errors.Is(err, syscall.ENOTSUP) {
+			err = nil // the file system does not support extended attributes
+		}
+		return nil, err
+	}
+	var xattrs map[string]string
+	for _, name := range strings.Split(string(names), "\x00") {
+		if name == "" {
+			continue
+		}
+		value, err := xattrCall(func(b []byte) (int, error) {
+			return syscall.Getxattr(path, name, b)
+		})
+		if err != nil {
+			if errors.Is(err, syscall.ENODATA) {
+				continue // removed since it was listed
+			}
+			return nil, err
+		}
+		if xattrs == nil {
+			xattrs = make(map[string]string)
+		}
+		xattrs[name] = string(value)
+	}
+	return xattrs, nil
+}
+
+// xattrCall calls f with a buffer large enough to hold its result, growing it
+// if the result changed size between calls.
+func xattrCall(f func([]byte) (int, error)) ([]byte, error) {
+	for {
+		n, err := f(nil)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, nil
+		}
+		b := make([]byte, n)
+		n, err = f(b)
+		if err == nil {
+			return b[:n], nil
+		}
+		if !errors.Is(err, syscall.ERANGE) {
+			return nil, err
+		}
+	}
+}
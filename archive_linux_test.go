@@ -0,0 +1,150 @@
+package tarfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stealthrocket/tarfs"
+)
+
+func TestArchiveOwnershipOS(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	xattrs := syscall.Setxattr(file, "user.tarfs", []byte("yes"), 0) == nil
+	devices := syscall.Mknod(filepath.Join(dir, "null"), syscall.S_IFCHR|0666, 1<<8|3) == nil
+
+	archive := bytes.NewBuffer(nil)
+	writer := tar.NewWriter(archive)
+	if err := tarfs.Archive(writer, os.DirFS(dir)); err != nil {
+		t.Fatal(err)
+	}
+	closeArchive(t, writer)
+
+	uname, gname := "", ""
+	if u, err := user.LookupId(strconv.Itoa(os.Getuid())); err == nil {
+		uname = u.Username
+	}
+	if g, err := user.LookupGroupId(strconv.Itoa(os.Getgid())); err == nil {
+		gname = g.Name
+	}
+
+	found := 0
+	reader := tar.NewReader(archive)
+	for {
+		h, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Uid != os.Getuid() || h.Gid != os.Getgid() || h.Uname != uname || h.Gname != gname {
+			t.Errorf("%s: owner mismatch: want=%d:%d (%s:%s) got=%d:%d (%s:%s)", h.Name,
+				os.Getuid(), os.Getgid(), uname, gname, h.Uid, h.Gid, h.Uname, h.Gname)
+		}
+		switch h.Name {
+		case "file":
+			found++
+			if xattrs && h.PAXRecords["SCHILY.xattr.user.tarfs"] != "yes" {
+				t.Errorf("%s: extended attribute not archived: %v", h.Name, h.PAXRecords)
+			}
+		case "null":
+			found++
+			if h.Typeflag != tar.TypeChar || h.Devmajor != 1 || h.Devminor != 3 || h.Size != 0 {
+				t.Errorf("%s: device mismatch: type=%c major=%d minor=%d size=%d", h.Name, h.Typeflag, h.Devmajor, h.Devminor, h.Size)
+			}
+		}
+	}
+	if want := map[bool]int{false: 1, true: 2}[devices]; found != want {
+		t.Errorf("wrong number of entries found: want=%d got=%d", want, found)
+	}
+	if !xattrs {
+		t.Log("extended attributes are not supported by the file system")
+	}
+
+	archive.Reset()
+	writer = tar.NewWriter(archive)
+	if err := tarfs.Archive(writer, os.DirFS(dir), tarfs.Reproducible(time.Unix(0, 0))); err != nil {
+		t.Fatal(err)
+	}
+	closeArchive(t, writer)
+
+	reader = tar.NewReader(archive)
+	for {
+		h, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(h.PAXRecords) != 0 {
+			t.Errorf("%s: PAX records archived in reproducible mode: %v", h.Name, h.PAXRecords)
+		}
+		if h.Name == "null" && (h.Devmajor != 1 || h.Devminor != 3) {
+			t.Errorf("%s: device mismatch: major=%d minor=%d", h.Name, h.Devmajor, h.Devminor)
+		}
+	}
+}
+
+func TestArchiveSparseOS(t *testing.T) {
+	const size = 8 << 20
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte("data"), 2<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	// Holes are supported if the first data is found past the beginning.
+	if offset, err := f.Seek(0, 3); err != nil || offset == 0 {
+		t.Skip("the file system does not support sparse files")
+	}
+	content := make([]byte, size)
+	copy(content[2<<20:], "data")
+
+	buffer := bytes.NewBuffer(nil)
+	if err := tarfs.WriteArchive(buffer, os.DirFS(dir)); err != nil {
+		t.Fatal(err)
+	}
+	if buffer.Len() > 64*1024 {
+		t.Errorf("tarball is too large: %d bytes", buffer.Len())
+	}
+	assertReadFile(t, openFS(t, buffer.Bytes()), "disk.img", string(content))
+
+	root := t.TempDir()
+	if err := tarfs.Extract(root, tar.NewReader(buffer)); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(root, "disk.img")
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Error("content mismatch")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocks := info.Sys().(*syscall.Stat_t).Blocks; blocks*512 >= size/2 {
+		t.Errorf("holes were not preserved when extracting: %d blocks allocated", blocks)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !darwin && !linux
+
+package tarfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+)
+
+func hasStat(info fs.FileInfo) bool { return false }
+
+func statDevice(info fs.FileInfo) (major, minor int64) { return 0, 0 }
+
+func readXattrs(path string) (map[string]string, error) { return nil, nil }
+
+func seekData(f *os.File, size int64) ([]sparseEntry, error) {
+	return nil, errors.New("seeking holes is not supported")
+}
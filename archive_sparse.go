@@ -0,0 +1,484 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	paxGNUSparseName     = "GNU.sparse.name"
+	paxGNUSparseRealSize = "GNU.sparse.realsize"
+
+	// Holes smaller than this size are archived as data, since they would
+	// not make up for the size of the sparse map and extra headers.
+	minHoleSize = 4096
+
+	// Files searched for holes are held in memory up to this size, and in a
+	// temporary file beyond.
+	maxSpoolMemory = 1024 * 1024
+
+	// Largest values of the octal fields of ustar headers, larger values are
+	// stored in PAX records.
+	maxOctal7  = 1<<21 - 1
+	maxOctal11 = 1<<33 - 1
+)
+
+// writeFile writes the regular file at path to the tarball, as a sparse entry
+// of the GNU PAX format 1.0 if it has holes of at least minHoleSize bytes.
+//
+// Unless reproducible is true, the holes are found from cheap hints when there
+// are any (see dataHint). Otherwise the file is read once, searching for blocks
+// of zeros while its data is written to a spool, which the content of the entry
+// is then copied from.
+func writeFile(tarball *tarStream, fsys fs.FS, path string, info fs.FileInfo, h *tar.Header, reproducible bool, buffer []byte) error {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var data io.ReaderAt
+	var fragments []sparseEntry
+	if !reproducible {
+		if data, fragments, err = dataHint(f, info, h.Size); err != nil {
+			return &fs.PathError{Op: "seek", Path: path, Err: err}
+		}
+	}
+	if data == nil {
+		s := new(spool)
+		defer s.Close()
+		if fragments, err = scanData(f, h.Size, s, buffer); err != nil {
+			return &fs.PathError{Op: "read", Path: path, Err: err}
+		}
+		data = &sparseReader{data: s, size: h.Size, sparse: fragments}
+	}
+
+	sparse := mergeData(fragments, h.Size)
+	if sparse == nil {
+		if err := tarball.WriteHeader(h); err != nil {
+			return &fs.PathError{Op: "write", Path: path, Err: err}
+		}
+		sparse = []sparseEntry{{length: h.Size}}
+	} else if err := writeSparseHeader(tarball, h, sparse); err != nil {
+		return &fs.PathError{Op: "write", Path: path, Err: err}
+	}
+
+	for _, s := range sparse {
+		n, err := io.CopyBuffer(tarball, io.NewSectionReader(data, s.offset, s.length), buffer)
+		if err != nil {
+			return err
+		}
+		if n != s.length {
+			err := fmt.Errorf("file size and number of bytes written mismatch: size=%d written=%d", h.Size, s.offset+n)
+			return &fs.PathError{Op: "write", Path: path, Err: err}
+		}
+	}
+	return nil
+}
+
+// dataHint returns the content of f, a file of the given size, and its data
+// fragments when they are known without reading it: the holes of *os.File
+// values are found with SEEK_DATA and SEEK_HOLE where supported, and the files
+// of file systems opened by this package have the holes of their entries. The
+// returned io.ReaderAt is nil if there are no hints.
+func dataHint(f fs.File, info fs.FileInfo, size int64) (io.ReaderAt, []sparseEntry, error) {
+	if file, ok := f.(*os.File); ok {
+		if fragments, err := seekData(file, size); err == nil {
+			return file, fragments, nil
+		}
+		// The file system does not support seeking holes, the file must be
+		// read from the beginning.
+		_, err := file.Seek(0, io.SeekStart)
+		return nil, nil, err
+	}
+	data, ok := f.(io.ReaderAt)
+	if !ok {
+		return nil, nil, nil
+	}
+	if fi, ok := info.(fileInfo); ok {
+		var entry *file
+		switch e := fi.node.entry.(type) {
+		case *file:
+			entry = e
+		case *link:
+			entry = e.target
+		}
+		if entry != nil && entry.size == size {
+			if entry.sparse == nil {
+				return data, []sparseEntry{{length: size}}, nil
+			}
+			return data, entry.sparse, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// scanData reads a file of the given size from r, and returns the fragments of
+// the file which are not made of blocks of zeros. The data of the fragments is
+// written to w, the phys field of the fragments being their offset in w.
+func scanData(r io.Reader, size int64, w io.Writer, buffer []byte) ([]sparseEntry, error) {
+	var fragments []sparseEntry
+	var stored int64
+
+	write := func(b []byte, offset int64) error {
+		if len(b) == 0 {
+			return nil
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		n := int64(len(b))
+		if i := len(fragments) - 1; i >= 0 && fragments[i].offset+fragments[i].length == offset {
+			fragments[i].length += n
+		} else {
+			fragments = append(fragments, sparseEntry{offset: offset, length: n, phys: stored})
+		}
+		stored += n
+		return nil
+	}
+
+	// The buffer is a multiple of the block size, so blocks are aligned on
+	// offsets of the file.
+	for offset := int64(0); offset < size; {
+		chunk := buffer
+		if remain := size - offset; int64(len(chunk)) > remain {
+			chunk = chunk[:remain]
+		}
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		data := 0 // start of the data of the chunk which was not written yet
+		for i := 0; i < len(chunk); i += headerSize {
+			block := chunk[i:]
+			if len(block) > headerSize {
+				block = block[:headerSize]
+			}
+			if isZero(block) {
+				if err := write(chunk[data:i], offset+int64(data)); err != nil {
+					return nil, err
+				}
+				data = i + len(block)
+			}
+		}
+		if err := write(chunk[data:], offset+int64(data)); err != nil {
+			return nil, err
+		}
+		offset += int64(len(chunk))
+	}
+	return fragments, nil
+}
+
+// spool holds the data of a file while it is searched for holes, in memory up
+// to maxSpoolMemory bytes, and in a temporary file beyond.
+type spool struct {
+	buffer []byte
+	file   *os.File
+}
+
+func (s *spool) Write(b []byte) (int, error) {
+	if s.file == nil {
+		if len(s.buffer)+len(b) <= maxSpoolMemory {
+			s.buffer = append(s.buffer, b...)
+			return len(b), nil
+		}
+		f, err := os.CreateTemp("", "tarfs-spool-*")
+		if err != nil {
+			return 0, err
+		}
+		s.file = f
+		if _, err := f.Write(s.buffer); err != nil {
+			return 0, err
+		}
+		s.buffer = nil
+	}
+	return s.file.Write(b)
+}
+
+func (s *spool) ReadAt(b []byte, offset int64) (int, error) {
+	if s.file != nil {
+		return s.file.ReadAt(b, offset)
+	}
+	return bytes.NewReader(s.buffer).ReadAt(b, offset)
+}
+
+// Close releases the memory or removes the temporary file of the spool.
+func (s *spool) Close() error {
+	s.buffer = nil
+	if s.file == nil {
+		return nil
+	}
+	defer os.Remove(s.file.Name())
+	return s.file.Close()
+}
+
+// mergeData merges the data fragments of a file separated by holes smaller than
+// minHoleSize, returning nil if the file has no holes left. Files ending with a
+// hole have a last fragment of zero length at the end of the file, like in the
+// sparse maps written by GNU tar.
+func mergeData(fragments []sparseEntry, size int64) []sparseEntry {
+	merged := make([]sparseEntry, 0, len(fragments)+1)
+	for _, f := range fragments {
+		if i := len(merged) - 1; i >= 0 && f.offset-(merged[i].offset+merged[i].length) < minHoleSize {
+			merged[i].length = f.offset + f.length - merged[i].offset
+		} else if i < 0 && f.offset < minHoleSize {
+			merged = append(merged, sparseEntry{offset: 0, length: f.offset + f.length})
+		} else {
+			merged = append(merged, f)
+		}
+	}
+	if i := len(merged) - 1; i >= 0 && size-(merged[i].offset+merged[i].length) < minHoleSize {
+		merged[i].length = size - merged[i].offset
+	}
+	if len(merged) == 1 && merged[0].offset == 0 && merged[0].length == size {
+		return nil
+	}
+	if i := len(merged) - 1; i < 0 || merged[i].offset+merged[i].length < size {
+		merged = append(merged, sparseEntry{offset: size})
+	}
+	phys := int64(0)
+	for i := range merged {
+		merged[i].phys, phys = phys, phys+merged[i].length
+	}
+	return merged
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// tarStream writes a tarball to an io.Writer. Headers are encoded by a scratch
+// tar.Writer, and the content of the entries is written directly to w, which
+// allows writing the sparse entries that the archive/tar package cannot write.
+type tarStream struct {
+	w      io.Writer
+	header bytes.Buffer
+	remain int64 // bytes of the current entry left to write
+	pad    int64
+}
+
+// WriteHeader writes h and prepares to accept the content of the entry, like
+// the method of tar.Writer.
+func (t *tarStream) WriteHeader(h *tar.Header) error {
+	t.header.Reset()
+	if err := tar.NewWriter(&t.header).WriteHeader(h); err != nil {
+		return err
+	}
+	size := h.Size
+	switch h.Typeflag {
+	case tar.TypeLink, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeDir, tar.TypeFifo:
+		size = 0 // header-only types
+	}
+	return t.writeHeader(t.header.Bytes(), size)
+}
+
+// writeHeader writes the encoded headers of an entry whose content stored in
+// the tarball is size bytes long.
+func (t *tarStream) writeHeader(header []byte, size int64) error {
+	if err := t.Flush(); err != nil {
+		return err
+	}
+	if _, err := t.w.Write(header); err != nil {
+		return err
+	}
+	t.remain, t.pad = size, padding(size)
+	return nil
+}
+
+func (t *tarStream) Write(b []byte) (int, error) {
+	overflow := int64(len(b)) > t.remain
+	if overflow {
+		b = b[:t.remain]
+	}
+	n, err := t.w.Write(b)
+	t.remain -= int64(n)
+	if err == nil && overflow {
+		err = tar.ErrWriteTooLong
+	}
+	return n, err
+}
+
+// Flush writes the padding of the current entry, which must be complete.
+func (t *tarStream) Flush() error {
+	if t.remain > 0 {
+		return fmt.Errorf("tarfs: missed writing %d bytes", t.remain)
+	}
+	_, err := t.w.Write(make([]byte, t.pad))
+	t.pad = 0
+	return err
+}
+
+// Close writes the end-of-archive marker, made of two zero blocks.
+func (t *tarStream) Close() error {
+	if err := t.Flush(); err != nil {
+		return err
+	}
+	_, err := t.w.Write(make([]byte, 2*headerSize))
+	return err
+}
+
+// writeSparseHeader writes the headers and sparse map of the sparse entry of
+// the file described by h, whose data fragments are listed in sparse. The data
+// of the fragments must be written next.
+func writeSparseHeader(tarball *tarStream, h *tar.Header, sparse []sparseEntry) error {
+	sparseMap := strconv.AppendInt(nil, int64(len(sparse)), 10)
+	sparseMap = append(sparseMap, '\n')
+	stored := int64(0)
+	for _, s := range sparse {
+		sparseMap = append(strconv.AppendInt(sparseMap, s.offset, 10), '\n')
+		sparseMap = append(strconv.AppendInt(sparseMap, s.length, 10), '\n')
+		stored += s.length
+	}
+	sparseMap = append(sparseMap, make([]byte, padding(int64(len(sparseMap))))...)
+	stored += int64(len(sparseMap))
+
+	if err := tarball.writeHeader(sparseHeaders(h, stored), stored); err != nil {
+		return err
+	}
+	_, err := tarball.Write(sparseMap)
+	return err
+}
+
+// sparseHeaders returns the extended header and ustar header of a sparse file
+// described by h, whose data stored in the tarball is size bytes long.
+func sparseHeaders(h *tar.Header, size int64) []byte {
+	dir, file := path.Split(h.Name)
+	mtime := h.ModTime.Unix()
+
+	records := map[string]string{
+		paxGNUSparseMajor:    "1",
+		paxGNUSparseMinor:    "0",
+		paxGNUSparseName:     h.Name,
+		paxGNUSparseRealSize: strconv.FormatInt(h.Size, 10),
+	}
+	for key, value := range h.PAXRecords {
+		records[key] = value
+	}
+	// Like the archive/tar package, a zero modification time is stored as the
+	// Unix epoch.
+	if nsec := h.ModTime.Nanosecond(); !h.ModTime.IsZero() && (nsec != 0 || mtime < 0 || mtime > maxOctal11) {
+		records["mtime"] = formatPAXTime(mtime, nsec)
+	}
+	if size > maxOctal11 {
+		records["size"] = strconv.FormatInt(size, 10)
+	}
+	if h.Uid > maxOctal7 {
+		records["uid"] = strconv.Itoa(h.Uid)
+	}
+	if h.Gid > maxOctal7 {
+		records["gid"] = strconv.Itoa(h.Gid)
+	}
+	if len(h.Uname) > 32 {
+		records["uname"] = h.Uname
+	}
+	if len(h.Gname) > 32 {
+		records["gname"] = h.Gname
+	}
+
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pax []byte
+	for _, key := range keys {
+		pax = appendPAXRecord(pax, key, records[key])
+	}
+
+	b := make([]byte, 0, 3*headerSize+len(pax))
+	b = append(b, ustarHeader(&tar.Header{
+		Typeflag: tar.TypeXHeader,
+		Name:     path.Join(dir, "PaxHeaders.0", file),
+		Size:     int64(len(pax)),
+	})...)
+	b = append(b, pax...)
+	b = append(b, make([]byte, padding(int64(len(pax))))...)
+	return append(b, ustarHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path.Join(dir, "GNUSparseFile.0", file),
+		Mode:     h.Mode,
+		Uid:      h.Uid,
+		Gid:      h.Gid,
+		Uname:    h.Uname,
+		Gname:    h.Gname,
+		Size:     size,
+		ModTime:  h.ModTime,
+	})...)
+}
+
+// formatPAXTime formats a time as a decimal number of seconds since the Unix
+// epoch, the fractional part being omitted if zero.
+func formatPAXTime(sec int64, nsec int) string {
+	if nsec == 0 {
+		return strconv.FormatInt(sec, 10)
+	}
+	sign := ""
+	if sec < 0 {
+		// The fractional part is added to the negative number of seconds.
+		sign, sec, nsec = "-", -(sec + 1), 1e9-nsec
+	}
+	return sign + strconv.FormatInt(sec, 10) + strings.TrimRight(fmt.Sprintf(".%09d", nsec), "0")
+}
+
+// ustarHeader encodes h as a ustar header block, truncating the fields which
+// do not fit.
+func ustarHeader(h *tar.Header) []byte {
+	b := make([]byte, headerSize)
+	octal := func(field []byte, v, max int64) {
+		if v < 0 || v > max {
+			v = 0 // stored in PAX records
+		}
+		copy(field, fmt.Sprintf("%0*o", len(field)-1, v))
+	}
+	copy(b[0:100], h.Name)
+	octal(b[100:108], h.Mode, maxOctal7)
+	octal(b[108:116], int64(h.Uid), maxOctal7)
+	octal(b[116:124], int64(h.Gid), maxOctal7)
+	octal(b[124:136], h.Size, maxOctal11)
+	octal(b[136:148], h.ModTime.Unix(), maxOctal11)
+	b[156] = h.Typeflag
+	copy(b[257:265], "ustar\x0000")
+	copy(b[265:297], h.Uname)
+	copy(b[297:329], h.Gname)
+
+	copy(b[148:156], "        ")
+	chksum := int64(0)
+	for _, c := range b {
+		chksum += int64(c)
+	}
+	copy(b[148:156], fmt.Sprintf("%06o\x00 ", chksum))
+	return b
+}
+
+// appendPAXRecord appends a record of a PAX extended header to b. Records start
+// with their length in decimal, which includes the digits of the length.
+func appendPAXRecord(b []byte, key, value string) []byte {
+	size := len(key) + len(value) + 3 // space, equal sign and newline
+	size += len(strconv.Itoa(size))
+	record := fmt.Sprintf("%d %s=%s\n", size, key, value)
+	if len(record) != size {
+		// Adding the length made it one digit longer.
+		record = fmt.Sprintf("%d %s=%s\n", len(record), key, value)
+	}
+	return append(b, record...)
+}
+
+// padding returns the number of bytes needed to align size on a block.
+func padding(size int64) int64 {
+	return (headerSize - size%headerSize) % headerSize
+}
@@ -0,0 +1,857 @@
+package tarfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stealthrocket/tarfs"
+)
+
+func TestArchiveHardLinks(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	writer := tar.NewWriter(buffer)
+	writeFile(t, writer, "usr/bin/python3.11", "python", 0755)
+	writeLink(t, writer, "usr/bin/python3", "usr/bin/python3.11")
+	writeLink(t, writer, "usr/bin/python", "usr/bin/python3.11")
+	writeFile(t, writer, "usr/bin/pip", "pip", 0755)
+	closeArchive(t, writer)
+
+	source := openFS(t, buffer.Bytes())
+	for _, test := range []struct {
+		name  string
+		ino   uint64
+		nlink uint64
+	}{
+		{name: "usr/bin/pip", ino: 1, nlink: 1},
+		{name: "usr/bin/python", ino: 2, nlink: 3},
+		{name: "usr/bin/python3", ino: 2, nlink: 3},
+		{name: "usr/bin/python3.11", ino: 2, nlink: 3},
+		{name: "usr/bin", ino: 0, nlink: 1},
+	} {
+		info, err := fs.Stat(source, test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ino, nlink := tarfs.Ino(info), tarfs.Nlink(info); ino != test.ino || nlink != test.nlink {
+			t.Errorf("%s: inode mismatch: want=%d,%d got=%d,%d", test.name, test.ino, test.nlink, ino, nlink)
+		}
+	}
+
+	archive := bytes.NewBuffer(nil)
+	writer = tar.NewWriter(archive)
+	if err := tarfs.Archive(writer, source); err != nil {
+		t.Fatal(err)
+	}
+	closeArchive(t, writer)
+
+	type entry struct {
+		typeflag byte
+		linkname string
+		size     int64
+	}
+	want := map[string]entry{
+		"usr/bin/pip":        {tar.TypeReg, "", 3},
+		"usr/bin/python":     {tar.TypeReg, "", 6},
+		"usr/bin/python3":    {tar.TypeLink, "usr/bin/python", 0},
+		"usr/bin/python3.11": {tar.TypeLink, "usr/bin/python", 0},
+	}
+
+	reader := tar.NewReader(bytes.NewReader(archive.Bytes()))
+	for {
+		h, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, ok := want[h.Name]
+		if !ok {
+			continue
+		}
+		got := entry{h.Typeflag, h.Linkname, h.Size}
+		if got != w {
+			t.Errorf("%s: entry mismatch: want=%+v got=%+v", h.Name, w, got)
+		}
+		delete(want, h.Name)
+	}
+	for name := range want {
+		t.Errorf("%s: missing entry", name)
+	}
+
+	fileSystem := openFS(t, archive.Bytes())
+	assertReadFile(t, fileSystem, "usr/bin/python3.11", "python")
+	assertReadFile(t, fileSystem, "usr/bin/pip", "pip")
+}
+
+func TestArchiveSpecialFiles(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	writer := tar.NewWriter(buffer)
+	for _, h := range []*tar.Header{
+		{Typeflag: tar.TypeFifo, Name: "run/fifo", Mode: 0600},
+		{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0666, Devmajor: 1, Devminor: 3},
+		{Typeflag: tar.TypeBlock, Name: "dev/sda", Mode: 0660, Devmajor: 8, Devminor: 1},
+	} {
+		if err := writer.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeArchive(t, writer)
+
+	archive := bytes.NewBuffer(nil)
+	writer = tar.NewWriter(archive)
+	if err := tarfs.Archive(writer, openFS(t, buffer.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	closeArchive(t, writer)
+
+	type entry struct {
+		typeflag byte
+		mode     int64
+		devmajor int64
+		devminor int64
+	}
+	want := map[string]entry{
+		"run/fifo": {tar.TypeFifo, 0600, 0, 0},
+		"dev/null": {tar.TypeChar, 0666, 1, 3},
+		"dev/sda":  {tar.TypeBlock, 0660, 8, 1},
+	}
+
+	reader := tar.NewReader(bytes.NewReader(archive.Bytes()))
+	for {
+		h, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, ok := want[h.Name]
+		if !ok {
+			continue
+		}
+		got := entry{h.Typeflag, h.Mode & 0777, h.Devmajor, h.Devminor}
+		if got != w {
+			t.Errorf("%s: entry mismatch: want=%+v got=%+v", h.Name, w, got)
+		}
+		delete(want, h.Name)
+	}
+	for name := range want {
+		t.Errorf("%s: missing entry", name)
+	}
+}
+
+func TestArchiveReproducible(t *testing.T) {
+	epoch := time.Unix(1e9, 0)
+
+	files := func(modTime time.Time) fstest.MapFS {
+		return fstest.MapFS{
+			"etc":       {Mode: fs.ModeDir | 0755, ModTime: modTime},
+			"etc/hosts": {Data: []byte("127.0.0.1 localhost\n"), Mode: 0644, ModTime: modTime},
+			"bin":       {Mode: fs.ModeDir | 0755, ModTime: modTime},
+			"bin/sh":    {Data: []byte("#!"), Mode: 0755, ModTime: modTime},
+			"old":       {Data: []byte("old"), Mode: 0600, ModTime: time.Unix(1e6, 0)},
+		}
+	}
+	archive := func(modTime time.Time) []byte {
+		t.Helper()
+		buffer := bytes.NewBuffer(nil)
+		writer := tar.NewWriter(buffer)
+		if err := tarfs.Archive(writer, files(modTime), tarfs.Reproducible(epoch)); err != nil {
+			t.Fatal(err)
+		}
+		closeArchive(t, writer)
+		return buffer.Bytes()
+	}
+
+	first := archive(time.Now())
+	second := archive(time.Now().Add(time.Hour + time.Millisecond))
+	if !bytes.Equal(first, second) {
+		t.Error("archives of the same content differ")
+	}
+
+	// Archives written by Archive and WriteArchive only differ when the
+	// file system contains sparse files.
+	buffer := bytes.NewBuffer(nil)
+	if err := tarfs.WriteArchive(buffer, files(time.Time{}), tarfs.Reproducible(epoch)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, buffer.Bytes()) {
+		t.Error("archives written by Archive and WriteArchive differ")
+	}
+
+	// The digest must not depend on the platform or the version of Go.
+	const want = "3e36b72dab188872869c2272e42a8747604b5dc9415357afc9b4a4307988aad5"
+	sum := sha256.Sum256(first)
+	if got := hex.EncodeToString(sum[:]); got != want {
+		t.Errorf("digest mismatch: want=%s got=%s", want, got)
+	}
+
+	reader := tar.NewReader(bytes.NewReader(first))
+	for {
+		h, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		modTime := epoch
+		if h.Name == "old" {
+			modTime = time.Unix(1e6, 0)
+		}
+		if !h.ModTime.Equal(modTime) {
+			t.Errorf("%s: modification time mismatch: want=%v got=%v", h.Name, modTime, h.ModTime)
+		}
+		if h.Uid != 0 || h.Gid != 0 || h.Uname != "" || h.Gname != "" {
+			t.Errorf("%s: owner was not reset: %d:%d (%s:%s)", h.Name, h.Uid, h.Gid, h.Uname, h.Gname)
+		}
+		if !h.AccessTime.IsZero() || !h.ChangeTime.IsZero() {
+			t.Errorf("%s: access or change time set", h.Name)
+		}
+	}
+}
+
+func TestSourceDateEpoch(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	if got := tarfs.SourceDateEpoch(); !got.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("time mismatch: want=%v got=%v", time.Unix(1700000000, 0), got)
+	}
+	t.Setenv("SOURCE_DATE_EPOCH", "invalid")
+	if got := tarfs.SourceDateEpoch(); !got.Equal(time.Unix(0, 0)) {
+		t.Errorf("time mismatch: want=%v got=%v", time.Unix(0, 0), got)
+	}
+}
+
+func TestArchiveExclude(t *testing.T) {
+	fileSystem := fstest.MapFS{
+		".git/HEAD":             {Data: []byte("ref: refs/heads/main")},
+		".git/config":           {},
+		"README.md":             {},
+		"build":                 {Data: []byte("build script")},
+		"docs/build/index.html": {},
+		"docs/guide.md":         {},
+		"main.go":               {},
+		"main.o":                {},
+		"keep.o":                {},
+		"src/lib/lib.o":         {},
+		"src/lib/lib.go":        {},
+		"src/testdata/a.txt":    {},
+		"vendor/mod/mod.go":     {},
+	}
+
+	for _, test := range []struct {
+		scenario string
+		options  []tarfs.Option
+		want     []string
+	}{
+		{
+			scenario: "no patterns",
+			want: []string{
+				".",
+				".git",
+				".git/HEAD",
+				".git/config",
+				"README.md",
+				"build",
+				"docs",
+				"docs/build",
+				"docs/build/index.html",
+				"docs/guide.md",
+				"keep.o",
+				"main.go",
+				"main.o",
+				"src",
+				"src/lib",
+				"src/lib/lib.go",
+				"src/lib/lib.o",
+				"src/testdata",
+				"src/testdata/a.txt",
+				"vendor",
+				"vendor/mod",
+				"vendor/mod/mod.go",
+			},
+		},
+		{
+			scenario: "patterns",
+			options: []tarfs.Option{
+				tarfs.Exclude(
+					"# version control",
+					".git",
+					"",
+					"*.o",
+					"!keep.o",
+					"build/",
+					"/vendor",
+					"src/**/testdata",
+					"docs/*.md",
+				),
+			},
+			want: []string{
+				".",
+				"README.md",
+				"build",
+				"docs",
+				"keep.o",
+				"main.go",
+				"src",
+				"src/lib",
+				"src/lib/lib.go",
+			},
+		},
+		{
+			scenario: "directory content",
+			options: []tarfs.Option{
+				tarfs.Exclude("src/**", "**/.git/**", "vendor/**/*.go"),
+			},
+			want: []string{
+				".",
+				".git",
+				"README.md",
+				"build",
+				"docs",
+				"docs/build",
+				"docs/build/index.html",
+				"docs/guide.md",
+				"keep.o",
+				"main.go",
+				"main.o",
+				"src",
+				"vendor",
+				"vendor/mod",
+			},
+		},
+		{
+			scenario: "filter",
+			options: []tarfs.Option{
+				tarfs.Exclude("*.o"),
+				tarfs.Filter(func(path string, entry fs.DirEntry) bool {
+					return !entry.IsDir() || path == "src" || path == "src/lib"
+				}),
+			},
+			want: []string{
+				".",
+				"README.md",
+				"build",
+				"main.go",
+				"src",
+				"src/lib",
+				"src/lib/lib.go",
+			},
+		},
+	} {
+		t.Run(test.scenario, func(t *testing.T) {
+			names, err := tarfs.ListArchive(fileSystem, test.options...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(names, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("entries mismatch:\nwant=%q\ngot= %q", test.want, names)
+			}
+
+			buffer := bytes.NewBuffer(nil)
+			writer := tar.NewWriter(buffer)
+			if err := tarfs.Archive(writer, fileSystem, test.options...); err != nil {
+				t.Fatal(err)
+			}
+			closeArchive(t, writer)
+
+			var archived []string
+			reader := tar.NewReader(buffer)
+			for {
+				h, err := reader.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				archived = append(archived, h.Name)
+			}
+			if strings.Join(archived, "\n") != strings.Join(names, "\n") {
+				t.Errorf("archived entries mismatch:\nwant=%q\ngot= %q", names, archived)
+			}
+		})
+	}
+
+	t.Run("excluded directories are not read", func(t *testing.T) {
+		var visited []string
+		_, err := tarfs.ListArchive(fileSystem, tarfs.Exclude("src/", "docs"), tarfs.Filter(func(path string, entry fs.DirEntry) bool {
+			visited = append(visited, path)
+			return true
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range visited {
+			if strings.HasPrefix(path, "src/") || strings.HasPrefix(path, "docs") {
+				t.Errorf("%s: entry of excluded directory visited", path)
+			}
+		}
+	})
+
+	t.Run("malformed pattern", func(t *testing.T) {
+		_, err := tarfs.ListArchive(fileSystem, tarfs.Exclude("[a-"))
+		if !errors.Is(err, path.ErrBadPattern) {
+			t.Errorf("error mismatch: want=%v got=%v", path.ErrBadPattern, err)
+		}
+	})
+}
+
+func TestArchiveNames(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	writer := tar.NewWriter(buffer)
+	writeFile(t, writer, "etc/config", "config", 0644)
+	writeFile(t, writer, "usr/bin/python3", "python", 0755)
+	writeLink(t, writer, "usr/bin/python3.11", "usr/bin/python3")
+	writeFile(t, writer, "usr/bin/pip", "pip", 0755)
+	closeArchive(t, writer)
+	fileSystem := openFS(t, buffer.Bytes())
+
+	for _, test := range []struct {
+		scenario string
+		options  []tarfs.Option
+		want     []string
+		links    map[string]string
+	}{
+		{
+			scenario: "prefix and rename",
+			options: []tarfs.Option{
+				tarfs.NamePrefix("opt/app"),
+				tarfs.Rename("opt/app/usr/bin", "opt/app/bin"),
+				tarfs.ImplicitDirMode(0700),
+			},
+			want: []string{
+				"opt",
+				"opt/app",
+				"opt/app/etc",
+				"opt/app/etc/config",
+				"opt/app/usr",
+				"opt/app/bin",
+				"opt/app/bin/pip",
+				"opt/app/bin/python3",
+				"opt/app/bin/python3.11",
+			},
+			links: map[string]string{
+				"opt/app/bin/python3.11": "opt/app/bin/python3",
+			},
+		},
+		{
+			scenario: "strip components",
+			options: []tarfs.Option{
+				tarfs.StripComponents(1),
+			},
+			want: []string{
+				"config",
+				"bin",
+				"bin/pip",
+				"bin/python3",
+				"bin/python3.11",
+			},
+			links: map[string]string{
+				"bin/python3.11": "bin/python3",
+			},
+		},
+		{
+			scenario: "map names",
+			options: []tarfs.Option{
+				tarfs.MapNames(func(name string) string {
+					if name == "etc" || strings.HasPrefix(name, "etc/") {
+						return ""
+					}
+					return strings.Replace(name, "usr/", "usr/local/", 1)
+				}),
+			},
+			want: []string{
+				".",
+				"usr",
+				"usr/local",
+				"usr/local/bin",
+				"usr/local/bin/pip",
+				"usr/local/bin/python3",
+				"usr/local/bin/python3.11",
+			},
+			links: map[string]string{
+				"usr/local/bin/python3.11": "usr/local/bin/python3",
+			},
+		},
+	} {
+		t.Run(test.scenario, func(t *testing.T) {
+			names, err := tarfs.ListArchive(fileSystem, test.options...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(names, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("entries mismatch:\nwant=%q\ngot= %q", test.want, names)
+			}
+
+			archive := bytes.NewBuffer(nil)
+			writer := tar.NewWriter(archive)
+			if err := tarfs.Archive(writer, fileSystem, test.options...); err != nil {
+				t.Fatal(err)
+			}
+			closeArchive(t, writer)
+
+			var archived []string
+			links := make(map[string]string)
+			reader := tar.NewReader(bytes.NewReader(archive.Bytes()))
+			for {
+				h, err := reader.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				archived = append(archived, h.Name)
+				if h.Typeflag == tar.TypeLink {
+					links[h.Name] = h.Linkname
+				}
+			}
+			if strings.Join(archived, "\n") != strings.Join(names, "\n") {
+				t.Errorf("archived entries mismatch:\nwant=%q\ngot= %q", names, archived)
+			}
+			if fmt.Sprint(links) != fmt.Sprint(test.links) {
+				t.Errorf("links mismatch: want=%v got=%v", test.links, links)
+			}
+
+			archivedFS := openFS(t, archive.Bytes())
+			for name := range test.links {
+				assertReadFile(t, archivedFS, name, "python")
+			}
+		})
+	}
+
+	t.Run("implicit directories", func(t *testing.T) {
+		archive := bytes.NewBuffer(nil)
+		writer := tar.NewWriter(archive)
+		if err := tarfs.Archive(writer, fileSystem, tarfs.NamePrefix("opt/app"), tarfs.ImplicitDirMode(0700), tarfs.ImplicitDirModTime(time.Unix(1e9, 0))); err != nil {
+			t.Fatal(err)
+		}
+		closeArchive(t, writer)
+
+		archivedFS := openFS(t, archive.Bytes())
+		assertDirInfo(t, archivedFS, "opt", 0700, time.Unix(1e9, 0))
+		assertReadFile(t, archivedFS, "opt/app/usr/bin/python3.11", "python")
+	})
+
+	t.Run("unsafe names", func(t *testing.T) {
+		_, err := tarfs.ListArchive(fileSystem, tarfs.MapNames(func(name string) string {
+			return "../" + name
+		}))
+		if !errors.Is(err, tarfs.ErrUnsafePath) {
+			t.Errorf("error mismatch: want=%v got=%v", tarfs.ErrUnsafePath, err)
+		}
+	})
+}
+
+func TestArchiveOwnership(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	writer := tar.NewWriter(buffer)
+	for _, h := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "home/user/", Mode: 0700, Uid: 1000, Gid: 100, Uname: "user", Gname: "users"},
+		{
+			Typeflag:   tar.TypeReg,
+			Name:       "usr/bin/ping",
+			Mode:       0755,
+			Uid:        0,
+			Gid:        0,
+			Uname:      "root",
+			Gname:      "root",
+			PAXRecords: map[string]string{"SCHILY.xattr.security.capability": "cap_net_raw", "comment": "ignored"},
+		},
+		{Typeflag: tar.TypeChar, Name: "dev/tty", Mode: 0666, Gid: 5, Gname: "tty", Devmajor: 5, Devminor: 0},
+		{Typeflag: tar.TypeBlock, Name: "dev/loop0", Mode: 0660, Gid: 6, Gname: "disk", Devmajor: 7, Devminor: 0},
+	} {
+		if err := writer.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeArchive(t, writer)
+	fileSystem := openFS(t, buffer.Bytes())
+
+	type entry struct {
+		uid, gid     int
+		uname, gname string
+		devmajor     int64
+		devminor     int64
+		xattr        string
+	}
+	for _, test := range []struct {
+		scenario string
+		options  []tarfs.Option
+		want     map[string]entry
+	}{
+		{
+			scenario: "preserved",
+			want: map[string]entry{
+				"home/user":    {1000, 100, "user", "users", 0, 0, ""},
+				"usr/bin/ping": {0, 0, "root", "root", 0, 0, "cap_net_raw"},
+				"dev/tty":      {0, 5, "", "tty", 5, 0, ""},
+				"dev/loop0":    {0, 6, "", "disk", 7, 0, ""},
+			},
+		},
+		{
+			scenario: "reproducible",
+			options:  []tarfs.Option{tarfs.Reproducible(time.Unix(0, 0))},
+			want: map[string]entry{
+				"home/user":    {0, 0, "", "", 0, 0, ""},
+				"usr/bin/ping": {0, 0, "", "", 0, 0, ""},
+				"dev/tty":      {0, 0, "", "", 5, 0, ""},
+				"dev/loop0":    {0, 0, "", "", 7, 0, ""},
+			},
+		},
+	} {
+		t.Run(test.scenario, func(t *testing.T) {
+			archive := bytes.NewBuffer(nil)
+			writer := tar.NewWriter(archive)
+			if err := tarfs.Archive(writer, fileSystem, test.options...); err != nil {
+				t.Fatal(err)
+			}
+			closeArchive(t, writer)
+
+			reader := tar.NewReader(archive)
+			for {
+				h, err := reader.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				want, ok := test.want[h.Name]
+				if !ok {
+					continue
+				}
+				got := entry{h.Uid, h.Gid, h.Uname, h.Gname, h.Devmajor, h.Devminor, h.PAXRecords["SCHILY.xattr.security.capability"]}
+				if got != want {
+					t.Errorf("%s: entry mismatch: want=%+v got=%+v", h.Name, want, got)
+				}
+				if _, ok := h.PAXRecords["comment"]; ok {
+					t.Errorf("%s: PAX record which is not an extended attribute archived", h.Name)
+				}
+				if h.Typeflag == tar.TypeChar && h.Size != 0 {
+					t.Errorf("%s: device has a size: %d", h.Name, h.Size)
+				}
+				delete(test.want, h.Name)
+			}
+			for name := range test.want {
+				t.Errorf("%s: missing entry", name)
+			}
+		})
+	}
+}
+
+func TestArchiveSparse(t *testing.T) {
+	const size = 1 << 20
+	fragments := []fragment{
+		{0, "head"},
+		{100, "small holes are archived as data"},
+		{300000, strings.Repeat("0123456789", 1000)},
+		{600000, "middle"},
+	}
+	content := make([]byte, size)
+	for _, f := range fragments {
+		copy(content[f.offset:], f.data)
+	}
+	dense := make([]byte, 3*4096)
+	copy(dense[4095:], "a")
+	copy(dense[8192:], "b")
+	modTime := time.Unix(1e9, 123456789)
+
+	fileSystem := fstest.MapFS{
+		"dir/sparse": {Data: content, Mode: 0644, ModTime: modTime},
+		"dir/dense":  {Data: dense, Mode: 0644, ModTime: modTime},
+		"holes":      {Data: make([]byte, size), Mode: 0600, ModTime: modTime},
+		"regular":    {Data: []byte("regular"), Mode: 0644, ModTime: modTime},
+	}
+	want := map[string][]byte{
+		"dir/sparse": content,
+		"dir/dense":  dense,
+		"holes":      make([]byte, size),
+		"regular":    []byte("regular"),
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	if err := tarfs.WriteArchive(buffer, fileSystem); err != nil {
+		t.Fatal(err)
+	}
+	archive := buffer.Bytes()
+	if len(archive) > 64*1024 {
+		t.Errorf("tarball is too large: %d bytes", len(archive))
+	}
+
+	t.Run("archive/tar", func(t *testing.T) {
+		found := 0
+		reader := tar.NewReader(bytes.NewReader(archive))
+		for {
+			h, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, ok := want[h.Name]
+			if !ok {
+				continue
+			}
+			found++
+			b, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, w) {
+				t.Errorf("%s: content mismatch", h.Name)
+			}
+			if !h.ModTime.Equal(modTime) {
+				t.Errorf("%s: modification time mismatch: want=%v got=%v", h.Name, modTime, h.ModTime)
+			}
+			if h.Mode&0777 != int64(fileSystem[h.Name].Mode) {
+				t.Errorf("%s: mode mismatch: want=%o got=%o", h.Name, fileSystem[h.Name].Mode, h.Mode)
+			}
+		}
+		if found != len(want) {
+			t.Errorf("wrong number of entries: want=%d got=%d", len(want), found)
+		}
+	})
+
+	t.Run("OpenFS", func(t *testing.T) {
+		archivedFS := openFS(t, archive)
+		for name, w := range want {
+			assertReadFile(t, archivedFS, name, string(w))
+		}
+		assertSparseReadAt(t, archivedFS, "dir/sparse", content)
+	})
+
+	t.Run("Extract", func(t *testing.T) {
+		root := t.TempDir()
+		if err := tarfs.Extract(root, tar.NewReader(bytes.NewReader(archive))); err != nil {
+			t.Fatal(err)
+		}
+		for name, w := range want {
+			b, err := os.ReadFile(filepath.Join(root, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, w) {
+				t.Errorf("%s: content mismatch", name)
+			}
+		}
+	})
+
+	t.Run("tar.Writer", func(t *testing.T) {
+		buffer := bytes.NewBuffer(nil)
+		writer := tar.NewWriter(buffer)
+		if err := tarfs.Archive(writer, fileSystem); err != nil {
+			t.Fatal(err)
+		}
+		closeArchive(t, writer)
+		if len(buffer.Bytes()) < 2*size {
+			t.Errorf("tarball is too small: %d bytes", len(buffer.Bytes()))
+		}
+	})
+
+	t.Run("zero modification time", func(t *testing.T) {
+		buffer := bytes.NewBuffer(nil)
+		if err := tarfs.WriteArchive(buffer, fstest.MapFS{"sparse": {Data: content, Mode: 0644}}); err != nil {
+			t.Fatal(err)
+		}
+		reader := tar.NewReader(buffer)
+		for {
+			h, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.Name == "sparse" && !h.ModTime.Equal(time.Unix(0, 0)) {
+				t.Errorf("%s: modification time mismatch: want=%v got=%v", h.Name, time.Unix(0, 0), h.ModTime)
+			}
+		}
+	})
+
+	t.Run("archive of OpenFS", func(t *testing.T) {
+		buffer := bytes.NewBuffer(nil)
+		if err := tarfs.WriteArchive(buffer, openFS(t, archive)); err != nil {
+			t.Fatal(err)
+		}
+		if buffer.Len() > 64*1024 {
+			t.Errorf("tarball is too large: %d bytes", buffer.Len())
+		}
+		fileSystem := openFS(t, buffer.Bytes())
+		for name, w := range want {
+			assertReadFile(t, fileSystem, name, string(w))
+		}
+	})
+
+	t.Run("read once", func(t *testing.T) {
+		// Files larger than the memory held by the archiver while searching
+		// for holes are spooled to a temporary file.
+		large := make([]byte, 3*size)
+		for i := range large[:2*size] {
+			large[i] = byte(i%255) + 1
+		}
+		fileSystem := &countingFS{FS: fstest.MapFS{
+			"dir/sparse": {Data: content, Mode: 0644},
+			"large":      {Data: large, Mode: 0644},
+		}}
+		buffer := bytes.NewBuffer(nil)
+		if err := tarfs.WriteArchive(buffer, fileSystem); err != nil {
+			t.Fatal(err)
+		}
+		if n, want := fileSystem.read, int64(len(content)+len(large)); n != want {
+			t.Errorf("wrong number of bytes read: want=%d got=%d", want, n)
+		}
+		if buffer.Len() > 3*size {
+			t.Errorf("tarball is too large: %d bytes", buffer.Len())
+		}
+		archivedFS := openFS(t, buffer.Bytes())
+		assertReadFile(t, archivedFS, "dir/sparse", string(content))
+		assertReadFile(t, archivedFS, "large", string(large))
+	})
+}
+
+// countingFS counts the bytes read from the files of a file system, which only
+// implement the methods of fs.File.
+type countingFS struct {
+	fs.FS
+	read int64
+}
+
+func (f *countingFS) Open(name string) (fs.File, error) {
+	file, err := f.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &countingFile{File: file, fs: f}, nil
+}
+
+func (f *countingFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(f.FS, name)
+}
+
+type countingFile struct {
+	fs.File
+	fs *countingFS
+}
+
+func (f *countingFile) Read(b []byte) (int, error) {
+	n, err := f.File.Read(b)
+	f.fs.read += int64(n)
+	return n, err
+}
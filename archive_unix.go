@@ -0,0 +1,44 @@
+//go:build linux || darwin
+
+package tarfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// hasStat returns true if info carries the metadata of a file of the OS.
+func hasStat(info fs.FileInfo) bool {
+	_, ok := info.Sys().(*syscall.Stat_t)
+	return ok
+}
+
+// seekData returns the data fragments of f, a file of the given size, found
+// with SEEK_DATA and SEEK_HOLE.
+func seekData(f *os.File, size int64) ([]sparseEntry, error) {
+	var fragments []sparseEntry
+	for offset := int64(0); offset < size; {
+		start, err := f.Seek(offset, seekWhenceData)
+		if err != nil {
+			if errors.Is(err, syscall.ENXIO) {
+				break // no data after offset
+			}
+			return nil, err
+		}
+		end, err := f.Seek(start, seekWhenceHole)
+		if err != nil {
+			return nil, err
+		}
+		if end > size {
+			end = size
+		}
+		if start >= end {
+			break
+		}
+		fragments = append(fragments, sparseEntry{offset: start, length: end - start})
+		offset = end
+	}
+	return fragments, nil
+}
@@ -0,0 +1,303 @@
+package tarfs
+
+import (
+	"container/list"
+	"io"
+	"io/fs"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultCacheBlockSize = 64 * 1024
+	// Number of blocks read ahead of sequential reads.
+	cacheReadahead = 4
+	// Number of concurrent sequential reads tracked for each reader.
+	cacheStreams = 8
+)
+
+// BlockCache configures the file system to cache the content of the tarball in
+// memory, in blocks of blockSize bytes (64 KiB if zero or negative), keeping
+// the most recently used blocks up to capacity bytes (at least one block).
+//
+// The cache is placed between the io.ReaderAt that the tarball is read from,
+// or the decompressor for compressed tarballs, and the files of the file system,
+// which makes small reads efficient when reading from slow backends. The cache
+// is shared by all the files opened from the file system. When reads of a file
+// are sequential, the blocks following them are fetched ahead of time.
+//
+// BlockCacheStats returns statistics on the use of the cache.
+func BlockCache(blockSize int, capacity int64) Option {
+	return func(c *config) {
+		if blockSize <= 0 {
+			blockSize = defaultCacheBlockSize
+		}
+		c.cacheBlockSize, c.cacheCapacity = blockSize, capacity
+	}
+}
+
+// CacheStats are statistics on the use of the block cache of a file system.
+type CacheStats struct {
+	// Number of blocks found in the cache, including blocks which were being
+	// fetched for other reads.
+	Hits int64
+	// Number of blocks fetched to serve reads.
+	Misses int64
+	// Number of bytes read from the underlying reader, including the blocks
+	// read ahead.
+	BytesFetched int64
+}
+
+// BlockCacheStats returns the statistics of the block cache of fsys, which must
+// be a file system opened by this package with the BlockCache option, otherwise
+// the returned statistics are all zero.
+func BlockCacheStats(fsys fs.FS) CacheStats {
+	var cache *blockCache
+	switch f := fsys.(type) {
+	case *fileSystem:
+		cache = f.cache
+	case *lazyFileSystem:
+		cache = f.cache
+	}
+	if cache == nil {
+		return CacheStats{}
+	}
+	return CacheStats{
+		Hits:         cache.hits.Load(),
+		Misses:       cache.misses.Load(),
+		BytesFetched: cache.bytesFetched.Load(),
+	}
+}
+
+// blockCache caches fixed-size blocks of data read from slow backends, evicting
+// the least recently used blocks when the capacity is exceeded. A cache may be
+// shared by multiple readers, each caching the data of a different backend.
+//
+// Concurrent reads of the same blocks share a single fetch, and the blocks
+// missing from the cache which are adjacent to each other are fetched with a
+// single call, which limits the number of round trips to remote backends.
+type blockCache struct {
+	blockSize int64
+	capacity  int // maximum number of blocks
+
+	mutex   sync.Mutex
+	blocks  map[blockKey]*cacheBlock
+	lru     list.List // most recently used blocks first
+	readers int
+
+	hits         atomic.Int64
+	misses       atomic.Int64
+	bytesFetched atomic.Int64
+}
+
+type blockKey struct {
+	reader int
+	index  int64
+}
+
+type cacheBlock struct {
+	key   blockKey
+	data  []byte
+	err   error         // reason why data is shorter than the block size
+	ready chan struct{} // closed once the block was fetched
+	elem  *list.Element
+}
+
+func newBlockCache(blockSize int, capacity int64) *blockCache {
+	c := &blockCache{
+		blockSize: int64(blockSize),
+		capacity:  int(capacity / int64(blockSize)),
+		blocks:    make(map[blockKey]*cacheBlock),
+	}
+	if c.capacity < 1 {
+		c.capacity = 1
+	}
+	return c
+}
+
+// reader returns an io.ReaderAt reading data through the cache.
+func (c *blockCache) reader(data io.ReaderAt) *cachedReader {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.readers++
+	return &cachedReader{cache: c, data: data, id: c.readers}
+}
+
+// cachedReader reads the data of a backend through a block cache.
+type cachedReader struct {
+	cache *blockCache
+	data  io.ReaderAt
+	id    int
+	// Recent sequences of contiguous reads, used to detect sequential reads.
+	// Guarded by the mutex of the cache.
+	streams [cacheStreams]struct{ start, end int64 }
+	stream  int
+}
+
+func (r *cachedReader) ReadAt(b []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	c := r.cache
+	end := offset + int64(len(b))
+	n := 0
+
+	for _, block := range r.lookup(offset, end) {
+		<-block.ready
+		start := block.key.index * c.blockSize
+		from, to := offset, end
+		if from < start {
+			from = start
+		}
+		if blockEnd := start + int64(len(block.data)); to > blockEnd {
+			to = blockEnd
+		}
+		if from < to {
+			n += copy(b[from-offset:to-offset], block.data[from-start:to-start])
+		}
+		if to < end && int64(len(block.data)) < c.blockSize {
+			return n, block.err
+		}
+	}
+	return n, nil
+}
+
+// lookup returns the blocks covering the range from offset to end, starting the
+// fetches of the blocks which are not in the cache yet, and of the blocks read
+// ahead if the read is sequential.
+func (r *cachedReader) lookup(offset, end int64) []*cacheBlock {
+	c := r.cache
+	first, last := offset/c.blockSize, (end-1)/c.blockSize
+	blocks := make([]*cacheBlock, 0, last-first+1)
+	var missing []*cacheBlock
+
+	c.mutex.Lock()
+	for i := first; i <= last; i++ {
+		block, ok := r.get(i)
+		if ok {
+			c.hits.Add(1)
+		} else {
+			c.misses.Add(1)
+			missing = append(missing, block)
+		}
+		blocks = append(blocks, block)
+	}
+	if r.sequential(offset, end) {
+		readahead := int64(cacheReadahead)
+		if max := int64(c.capacity / 2); readahead > max {
+			readahead = max
+		}
+		for i := last + 1; i <= last+readahead; i++ {
+			if block, ok := r.get(i); !ok {
+				missing = append(missing, block)
+			}
+		}
+	}
+	for c.lru.Len() > c.capacity {
+		c.evict(c.lru.Back().Value.(*cacheBlock))
+	}
+	c.mutex.Unlock()
+
+	for len(missing) > 0 {
+		run := 1
+		for run < len(missing) && missing[run].key.index == missing[run-1].key.index+1 {
+			run++
+		}
+		go r.load(missing[:run])
+		missing = missing[run:]
+	}
+	return blocks
+}
+
+// get returns the block at index, creating it if it is not in the cache, in
+// which case the second return value is false and the block must be loaded.
+// The cache mutex must be held.
+func (r *cachedReader) get(index int64) (*cacheBlock, bool) {
+	c := r.cache
+	key := blockKey{r.id, index}
+	if block, ok := c.blocks[key]; ok {
+		c.lru.MoveToFront(block.elem)
+		return block, true
+	}
+	block := &cacheBlock{key: key, ready: make(chan struct{})}
+	block.elem = c.lru.PushFront(block)
+	c.blocks[key] = block
+	return block, false
+}
+
+// sequential returns true if a read starting at offset continues a sequence of
+// contiguous reads spanning at least a block, and records the read. Short
+// sequences are ignored, they are frequent when scanning the headers of the
+// tarball. The cache mutex must be held.
+func (r *cachedReader) sequential(offset, end int64) bool {
+	for i := range r.streams {
+		if s := &r.streams[i]; s.end == offset && offset != 0 {
+			s.end = end
+			return s.end-s.start >= r.cache.blockSize
+		}
+	}
+	r.streams[r.stream].start, r.streams[r.stream].end = offset, end
+	r.stream = (r.stream + 1) % cacheStreams
+	return false
+}
+
+// load fetches a run of consecutive blocks.
+func (r *cachedReader) load(blocks []*cacheBlock) {
+	c := r.cache
+	data := make([]byte, int64(len(blocks))*c.blockSize)
+	n, err := r.data.ReadAt(data, blocks[0].key.index*c.blockSize)
+	if n == len(data) {
+		err = nil
+	} else if err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	c.bytesFetched.Add(int64(n))
+	data = data[:n]
+
+	for _, block := range blocks {
+		size := c.blockSize
+		if size > int64(len(data)) {
+			size = int64(len(data))
+			block.err = err
+		}
+		block.data, data = data[:size:size], data[size:]
+
+		if block.err != nil && block.err != io.EOF {
+			// Blocks which could not be fetched entirely are removed from
+			// the cache so the next reads retry fetching them.
+			c.mutex.Lock()
+			if c.blocks[block.key] == block {
+				c.evict(block)
+			}
+			c.mutex.Unlock()
+		}
+		close(block.ready)
+	}
+}
+
+// insert adds to the cache the data of a block fetched by other means.
+func (r *cachedReader) insert(index int64, data []byte) {
+	c := r.cache
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if block, ok := r.get(index); !ok {
+		block.data = data
+		if int64(len(data)) < c.blockSize {
+			block.err = io.EOF
+		}
+		close(block.ready)
+	}
+}
+
+func (c *blockCache) evict(block *cacheBlock) {
+	c.lru.Remove(block.elem)
+	delete(c.blocks, block.key)
+}
+
+var (
+	_ io.ReaderAt = (*cachedReader)(nil)
+)
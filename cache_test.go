@@ -0,0 +1,189 @@
+package tarfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stealthrocket/tarfs"
+)
+
+func TestBlockCache(t *testing.T) {
+	const blockSize, numFiles = 4096, 10
+
+	buffer := bytes.NewBuffer(nil)
+	writer := tar.NewWriter(buffer)
+	prng := rand.New(rand.NewSource(0))
+	blob := string(randomBytes(prng, 256*1024))
+	writeFile(t, writer, "blob", blob, 0644)
+	for i := 0; i < numFiles; i++ {
+		writeFile(t, writer, fmt.Sprintf("files/file-%d", i), fmt.Sprint(i), 0644)
+	}
+	closeArchive(t, writer)
+	archive := buffer.Bytes()
+
+	for _, test := range []struct {
+		scenario string
+		data     []byte
+		options  []tarfs.Option
+	}{
+		{scenario: "tar", data: archive},
+		{scenario: "tar.gz", data: compress(t, archive, gzip.BestSpeed, 1)},
+		{scenario: "lazy tar.gz", data: compress(t, archive, gzip.BestSpeed, 1), options: []tarfs.Option{tarfs.Lazy()}},
+	} {
+		t.Run(test.scenario, func(t *testing.T) {
+			open := func(t *testing.T) (fs.FS, *countingReaderAt) {
+				data := &countingReaderAt{data: test.data}
+				options := append([]tarfs.Option{tarfs.BlockCache(blockSize, 128*1024)}, test.options...)
+				fileSystem, err := tarfs.OpenFS(data, int64(len(test.data)), options...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return fileSystem, data
+			}
+
+			t.Run("small reads", func(t *testing.T) {
+				fileSystem, _ := open(t)
+				f, err := fileSystem.Open("blob")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+
+				before := tarfs.BlockCacheStats(fileSystem)
+				r := f.(io.ReaderAt)
+				b := make([]byte, 100)
+				for offset := 0; offset < 8*blockSize; offset += len(b) {
+					if _, err := r.ReadAt(b, int64(offset)); err != nil {
+						t.Fatal(err)
+					}
+					if string(b) != blob[offset:offset+len(b)] {
+						t.Fatalf("content mismatch at offset %d", offset)
+					}
+				}
+				stats := tarfs.BlockCacheStats(fileSystem)
+				if misses := stats.Misses - before.Misses; misses > 10 {
+					t.Errorf("too many cache misses: %d", misses)
+				}
+				if stats.Hits-before.Hits < 300 {
+					t.Errorf("too few cache hits: %d", stats.Hits-before.Hits)
+				}
+			})
+
+			t.Run("sequential reads", func(t *testing.T) {
+				fileSystem, _ := open(t)
+				f, err := fileSystem.Open("blob")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+
+				before := tarfs.BlockCacheStats(fileSystem)
+				b := bytes.NewBuffer(nil)
+				if _, err := io.CopyBuffer(struct{ io.Writer }{b}, struct{ io.Reader }{f}, make([]byte, 1000)); err != nil {
+					t.Fatal(err)
+				}
+				if b.String() != blob {
+					t.Error("content mismatch")
+				}
+
+				// Blocks read ahead are not counted as misses.
+				stats := tarfs.BlockCacheStats(fileSystem)
+				if misses := stats.Misses - before.Misses; misses > int64(len(blob))/blockSize/2 {
+					t.Errorf("too many cache misses: %d", misses)
+				}
+			})
+
+			t.Run("shared by all files", func(t *testing.T) {
+				fileSystem, data := open(t)
+				// The blocks at the end of compressed tarballs cannot be
+				// cached before the scan completes, since the size of the
+				// tarball is unknown until then.
+				if _, err := fs.ReadDir(fileSystem, "."); err != nil {
+					t.Fatal(err)
+				}
+				for i := 0; i < numFiles; i++ {
+					assertReadFile(t, fileSystem, fmt.Sprintf("files/file-%d", i), fmt.Sprint(i))
+				}
+				reads := data.reads.Load()
+				stats := tarfs.BlockCacheStats(fileSystem)
+
+				var wg sync.WaitGroup
+				for i := 0; i < numFiles; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						assertReadFile(t, fileSystem, fmt.Sprintf("files/file-%d", i), fmt.Sprint(i))
+					}(i)
+				}
+				wg.Wait()
+
+				if n := data.reads.Load(); n != reads {
+					t.Errorf("files read again from the tarball: %d reads", n-reads)
+				}
+				if n := tarfs.BlockCacheStats(fileSystem).Misses; n != stats.Misses {
+					t.Errorf("unexpected cache misses: %d", n-stats.Misses)
+				}
+			})
+
+			t.Run("statistics during the scan", func(t *testing.T) {
+				fileSystem, _ := open(t)
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					if _, err := fs.ReadDir(fileSystem, "."); err != nil {
+						t.Error(err)
+					}
+				}()
+				for {
+					tarfs.BlockCacheStats(fileSystem)
+					select {
+					case <-done:
+						return
+					default:
+					}
+				}
+			})
+
+			t.Run("index", func(t *testing.T) {
+				fileSystem, _ := open(t)
+				index := writeIndex(t, fileSystem)
+				f, err := tarfs.OpenFSWithIndex(bytes.NewReader(test.data), int64(len(test.data)), bytes.NewReader(index),
+					tarfs.BlockCache(blockSize, 128*1024))
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertReadFile(t, f, "blob", blob)
+				if stats := tarfs.BlockCacheStats(f); stats.BytesFetched == 0 {
+					t.Error("data was not read through the cache")
+				}
+			})
+		})
+	}
+
+	t.Run("no cache", func(t *testing.T) {
+		fileSystem := openFS(t, archive)
+		assertReadFile(t, fileSystem, "blob", blob)
+		if stats := tarfs.BlockCacheStats(fileSystem); stats != (tarfs.CacheStats{}) {
+			t.Errorf("unexpected cache statistics: %+v", stats)
+		}
+	})
+}
+
+// countingReaderAt counts the reads of the data.
+type countingReaderAt struct {
+	data  []byte
+	reads atomic.Int64
+}
+
+func (r *countingReaderAt) ReadAt(b []byte, offset int64) (int, error) {
+	r.reads.Add(1)
+	return bytes.NewReader(r.data).ReadAt(b, offset)
+}
@@ -3,25 +3,35 @@ package tarfs
 import (
 	"archive/tar"
 	"io/fs"
-	"path"
-	"time"
 )
 
-type deny struct{ header *tar.Header }
+// deny represents entries which cannot be opened, such as named pipes and
+// device nodes, or entries of types that the package does not support. They
+// can be found by Stat, and their device numbers are available in the tar
+// header returned by Header.
+type deny struct{ meta }
 
-func (d deny) open(fileSystem *fileSystem) (fs.File, error) {
+func (d *deny) open(n *node) (fs.File, error) {
 	return nil, fs.ErrPermission
 }
 
-func (d deny) stat() fs.FileInfo {
-	return denyInfo{d.header}
+func (d *deny) stat(n *node) fs.FileInfo {
+	return fileInfo{node: n, meta: &d.meta, size: d.size}
 }
 
-type denyInfo struct{ header *tar.Header }
-
-func (info denyInfo) Name() string       { return path.Base(info.header.Name) }
-func (info denyInfo) Size() int64        { return info.header.Size }
-func (info denyInfo) Mode() fs.FileMode  { return fs.FileMode(info.header.Mode & ^0777) }
-func (info denyInfo) ModTime() time.Time { return info.header.ModTime }
-func (info denyInfo) IsDir() bool        { return info.Mode().IsDir() }
-func (info denyInfo) Sys() any           { return nil }
+// denyMode returns the mode of the entry described by h. The type bits are
+// derived from the type flag only, since the mode field of the header may
+// carry unrelated file type bits (e.g. the directory bit).
+func denyMode(h *tar.Header) fs.FileMode {
+	mode := h.FileInfo().Mode() &^ fs.ModeType
+	switch h.Typeflag {
+	case tar.TypeFifo:
+		return mode | fs.ModeNamedPipe
+	case tar.TypeChar:
+		return mode | fs.ModeDevice | fs.ModeCharDevice
+	case tar.TypeBlock:
+		return mode | fs.ModeDevice
+	default:
+		return mode | fs.ModeIrregular
+	}
+}
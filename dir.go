@@ -3,69 +3,49 @@ package tarfs
 import (
 	"io"
 	"io/fs"
-	"path"
-	"sort"
 	"sync"
-	"time"
 )
 
-type dir struct {
-	name    string
-	modTime time.Time
-	entries map[string]struct{}
-}
+// dir is a directory of the file system, its entries are the children of the
+// node that it is the entry of.
+type dir struct{ meta } // meta.data is nil for implicit directories
 
-func (d *dir) open(fileSystem *fileSystem) (fs.File, error) {
-	return &openDir{fs: fileSystem, dir: d, entries: d.readDirNames()}, nil
+func (d *dir) implicit() bool {
+	return d.data == nil
 }
 
-func (d *dir) stat() fs.FileInfo {
-	return dirInfo{d}
+func (d *dir) open(n *node) (fs.File, error) {
+	return &openDir{node: n, entries: n.children}, nil
 }
 
-func (d *dir) readDirNames() []string {
-	names := make([]string, 0, len(d.entries))
-	for name := range d.entries {
-		names = append(names, name)
-	}
-	sort.Strings(names)
-	return names
+func (d *dir) stat(n *node) fs.FileInfo {
+	return fileInfo{node: n, meta: &d.meta}
 }
 
-func (d *dir) readDir(fileSystem *fileSystem) ([]fs.DirEntry, error) {
-	return readDirEntries(fileSystem, d.readDirNames())
+func (d *dir) readDir(n *node) ([]fs.DirEntry, error) {
+	return readDirEntries(n.children), nil
 }
 
-func readDirEntries(fileSystem *fileSystem, names []string) ([]fs.DirEntry, error) {
-	entries := make([]fs.DirEntry, len(names))
-	for i, name := range names {
-		entries[i] = fs.FileInfoToDirEntry(fileSystem.files[name].stat())
+func readDirEntries(nodes []*node) []fs.DirEntry {
+	entries := make([]fs.DirEntry, len(nodes))
+	for i, n := range nodes {
+		entries[i] = fs.FileInfoToDirEntry(n.entry.stat(n))
 	}
-	return entries, nil
+	return entries
 }
 
-type dirInfo struct{ *dir }
-
-func (info dirInfo) Name() string       { return path.Base(info.name) }
-func (info dirInfo) Size() int64        { return 0 }
-func (info dirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0755 }
-func (info dirInfo) ModTime() time.Time { return info.modTime }
-func (info dirInfo) IsDir() bool        { return true }
-func (info dirInfo) Sys() any           { return nil }
-
 type openDir struct {
 	mutex   sync.Mutex
-	fs      *fileSystem
-	dir     *dir
-	entries []string
+	node    *node
+	entries []*node // shared with the node, must not be modified
 }
 
 func (d *openDir) Read([]byte) (int, error) {
-	return 0, &fs.PathError{"read", d.dir.stat().Name(), fs.ErrInvalid}
+	return 0, &fs.PathError{Op: "read", Path: d.node.name, Err: fs.ErrInvalid}
 }
 
 func (d *openDir) Stat() (fs.FileInfo, error) {
-	return d.dir.stat(), nil
+	return d.node.entry.stat(d.node), nil
 }
 
 func (d *openDir) Close() error {
@@ -76,15 +56,15 @@ func (d *openDir) Close() error {
 }
 
 func (d *openDir) ReadDir(n int) (entries []fs.DirEntry, err error) {
-	if names := d.readDir(n); len(names) > 0 {
-		entries, err = readDirEntries(d.fs, names)
+	if nodes := d.readDir(n); len(nodes) > 0 {
+		entries = readDirEntries(nodes)
 	} else if n > 0 {
 		err = io.EOF
 	}
 	return entries, err
 }
 
-func (d *openDir) readDir(n int) (entries []string) {
+func (d *openDir) readDir(n int) (entries []*node) {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
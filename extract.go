@@ -6,24 +6,84 @@ import (
 	"io"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 )
 
-// Extract extracts files from the tarbal to a directory at path on the file
+// Extract extracts files from the tarbal to a directory at root on the file
 // system.
 //
+// The resource limits set by the options are enforced during the extraction,
+// the other options do not apply.
+//
+// Symbolic links extracted from the tarball are created verbatim, but they are
+// resolved as if root was the root of a chroot when they appear in the parent
+// directories of other entries, so the extraction never writes files outside of
+// root.
+//
 // Note: at this time, since fs.FS is a read-only API, we chose to only support
 // extracting files to a local path. This could be revisited in the future if Go
 // gets an API to interact with writable file systems, likely we would then add
 // a ExtractFS function to maintain backward compatiblity.
-func Extract(path string, tarball *tar.Reader) error {
-	unresolvedLinks := make(map[string]*tar.Header)
+func Extract(root string, tarball *tar.Reader, options ...Option) error {
+	limiter := &limiter{limits: newConfig(options).limits}
+	unresolvedLinks := make(map[string][]*tar.Header)
+	skippedEntries := make(map[string]struct{})
 	buffer := make([]byte, 32*1024)
 	directories := make([]*tar.Header, 0, 512)
 
-	err := walk(tarball, func(h *tar.Header) error {
-		fileName := filepath.FromSlash(h.Name)
-		filePath := filepath.Join(path, fileName)
+	// skip records that an entry was not extracted, as well as the hard links
+	// that were waiting for it.
+	var skip func(name string)
+	skip = func(name string) {
+		skippedEntries[name] = struct{}{}
+		links := unresolvedLinks[name]
+		delete(unresolvedLinks, name)
+		for _, link := range links {
+			skip(link.Name)
+		}
+	}
+
+	// resolveLinks creates the hard links waiting for the entry named name to
+	// be extracted at filePath, which may themselves be targets of other links.
+	var resolveLinks func(name, filePath string) error
+	resolveLinks = func(name, filePath string) error {
+		links := unresolvedLinks[name]
+		delete(unresolvedLinks, name)
+
+		for _, link := range links {
+			linkPath, err := resolvePath(root, link.Name, limiter.maxSymlinks())
+			if err != nil {
+				return err
+			}
+			if err := os.Link(filePath, linkPath); err != nil {
+				if !errors.Is(err, fs.ErrNotExist) {
+					return err
+				}
+			}
+			if err := chmodlink(linkPath, link); err != nil {
+				return err
+			}
+			if err := resolveLinks(link.Name, linkPath); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err := walk(tarball, func(h *tar.Header, _ string) error {
+		if err := limiter.check(h); err != nil {
+			return err
+		}
+		if err := limiter.checkDir(h.Name); err != nil {
+			return err
+		}
+
+		filePath, err := resolvePath(root, h.Name, limiter.maxSymlinks())
+		if err != nil {
+			return err
+		}
 
 		if err := os.MkdirAll(filepath.Dir(filePath), 0777); err != nil {
 			return err
@@ -45,10 +105,10 @@ func Extract(path string, tarball *tar.Reader) error {
 
 		case tar.TypeFifo:
 			// TODO: support creating named pipes
+			skip(h.Name)
 			return nil
 
 		case tar.TypeSymlink:
-			// TODO: test with relative and absolute link names
 			// TODO: set times of symbolic link (Go has no API in the os package for that)
 			if err := os.Symlink(h.Linkname, filePath); err != nil {
 				if !errors.Is(err, fs.ErrExist) {
@@ -57,17 +117,25 @@ func Extract(path string, tarball *tar.Reader) error {
 			}
 
 		case tar.TypeLink:
-			linkName := filepath.FromSlash(h.Linkname)
-			linkPath := filepath.Join(path, linkName)
+			linkName := cleanLinkname(h.Linkname)
+			if _, skipped := skippedEntries[linkName]; skipped {
+				skip(h.Name)
+				return nil
+			}
+
+			linkPath, err := resolvePath(root, linkName, limiter.maxSymlinks())
+			if err != nil {
+				return err
+			}
 
 			if err := os.Link(linkPath, filePath); err != nil {
 				if errors.Is(err, fs.ErrNotExist) {
-					unresolvedLinks[h.Linkname] = h
+					unresolvedLinks[linkName] = append(unresolvedLinks[linkName], h)
 					return nil
 				}
 				return err
 			}
-			if err := chmodtimes(filePath, h); err != nil {
+			if err := chmodlink(filePath, h); err != nil {
 				return err
 			}
 
@@ -84,14 +152,26 @@ func Extract(path string, tarball *tar.Reader) error {
 				// TODO: support creating devices
 				// maj := int(h.Devmajor)
 				// min := int(h.Devminor)
+				skip(h.Name)
 				return nil
 			}
+			// Replace symbolic links instead of writing to their target,
+			// which could be located anywhere on the file system.
+			if info, err := os.Lstat(filePath); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+				if err := os.Remove(filePath); err != nil {
+					return err
+				}
+			}
 			f, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
 			if err != nil {
 				return err
 			}
 			defer f.Close()
-			if h.Size > 0 {
+			if h.Size > 0 && isSparse(h) {
+				if err := copySparse(f, tarball, h.Size, buffer); err != nil {
+					return err
+				}
+			} else if h.Size > 0 {
 				if _, err := io.CopyBuffer(struct{ io.Writer }{f}, tarball, buffer); err != nil {
 					return err
 				}
@@ -101,21 +181,7 @@ func Extract(path string, tarball *tar.Reader) error {
 			}
 		}
 
-		if link, ok := unresolvedLinks[h.Name]; ok {
-			linkName := filepath.FromSlash(link.Name)
-			linkPath := filepath.Join(path, linkName)
-
-			if err := os.Link(filePath, linkPath); err != nil {
-				if !errors.Is(err, fs.ErrNotExist) {
-					return err
-				}
-			}
-			if err := chmodtimes(linkPath, link); err != nil {
-				return err
-			}
-			delete(unresolvedLinks, h.Name)
-		}
-		return nil
+		return resolveLinks(h.Name, filePath)
 	})
 	if err != nil {
 		return err
@@ -128,8 +194,10 @@ func Extract(path string, tarball *tar.Reader) error {
 	}
 
 	for _, dir := range directories {
-		dirName := filepath.FromSlash(dir.Name)
-		dirPath := filepath.Join(path, dirName)
+		dirPath, err := resolvePath(root, dir.Name, limiter.maxSymlinks())
+		if err != nil {
+			return err
+		}
 		if err := chmodtimes(dirPath, dir); err != nil {
 			return err
 		}
@@ -137,6 +205,62 @@ func Extract(path string, tarball *tar.Reader) error {
 	return nil
 }
 
+// resolvePath returns the location on the local file system of the entry named
+// name extracted to the directory at root. Symbolic links in the parent
+// directories of the entry are resolved as if root was the root of a chroot,
+// following at most maxSymlinks links.
+func resolvePath(root, name string, maxSymlinks int) (string, error) {
+	dir, base := path.Split(path.Join("/", name))
+	resolved := "."
+	links := 0
+
+	for dir != "" {
+		var elem string
+		elem, dir, _ = strings.Cut(dir, "/")
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, elem)
+		nextPath := filepath.Join(root, filepath.FromSlash(next))
+		// Directories which do not exist yet are created by the caller.
+		info, err := os.Lstat(nextPath)
+		if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if links++; links > maxSymlinks {
+			return "", &fs.PathError{Op: "open", Path: name, Err: ErrLoop}
+		}
+		link, err := os.Readlink(nextPath)
+		if err != nil {
+			return "", err
+		}
+		link = filepath.ToSlash(link)
+		if strings.HasPrefix(link, "/") {
+			resolved = "."
+		}
+		dir = link + "/" + dir
+	}
+
+	return filepath.Join(root, filepath.FromSlash(resolved), base), nil
+}
+
+// chmodlink sets the permissions and times of a hard link, unless it links to a
+// symbolic link, since changing it would change the target of the symbolic link.
+func chmodlink(path string, file *tar.Header) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&fs.ModeSymlink != 0 {
+		return err
+	}
+	return chmodtimes(path, file)
+}
+
 func chmodtimes(path string, file *tar.Header) error {
 	if err := chmod(path, file); err != nil {
 		return err
@@ -154,3 +278,37 @@ func chmod(path string, file *tar.Header) error {
 func chtimes(path string, file *tar.Header) error {
 	return os.Chtimes(path, file.AccessTime, file.ModTime)
 }
+
+// isSparse returns true if h is the header of a sparse file in one of the GNU
+// PAX formats.
+func isSparse(h *tar.Header) bool {
+	return h.PAXRecords[paxGNUSparseMajor] != "" || h.PAXRecords[paxGNUSparseMap] != ""
+}
+
+// copySparse copies the content of a sparse file to f, seeking over the chunks
+// of zeros instead of writing them so the holes are preserved on file systems
+// which support sparse files.
+func copySparse(f *os.File, r io.Reader, size int64, buffer []byte) error {
+	for copied := int64(0); ; {
+		n, err := io.ReadFull(r, buffer)
+		if copied += int64(n); n > 0 {
+			var werr error
+			if isZero(buffer[:n]) {
+				_, werr = f.Seek(int64(n), io.SeekCurrent)
+			} else {
+				_, werr = f.Write(buffer[:n])
+			}
+			if werr != nil {
+				return werr
+			}
+		}
+		if (err == io.EOF || err == io.ErrUnexpectedEOF) && copied == size {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Holes at the end of the file are only created by setting its size.
+	return f.Truncate(size)
+}
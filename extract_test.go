@@ -3,8 +3,10 @@ package tarfs_test
 import (
 	"archive/tar"
 	"bytes"
+	"errors"
 	"io/fs"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stealthrocket/tarfs"
@@ -39,3 +41,90 @@ func TestExtractArchive(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestExtractSymlinks(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	writer := tar.NewWriter(buffer)
+	writeDir(t, writer, "etc")
+	writeSymlink(t, writer, "relative", "etc")
+	writeSymlink(t, writer, "absolute", "/etc")
+	writeSymlink(t, writer, "escape", "../../..")
+	writeFile(t, writer, "relative/one", "1", 0644)
+	writeFile(t, writer, "absolute/two", "2", 0644)
+	writeFile(t, writer, "escape/etc/three", "3", 0644)
+	writeSymlink(t, writer, "etc/four", "/tmp/four")
+	writeFile(t, writer, "etc/four", "4", 0644)
+	writeLink(t, writer, "five", "escape/etc/one")
+	closeArchive(t, writer)
+
+	parent := t.TempDir()
+	tmp := filepath.Join(parent, "root")
+	if err := tarfs.Extract(tmp, tar.NewReader(buffer)); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := os.DirFS(tmp)
+	for name, link := range map[string]string{
+		"relative": "etc",
+		"absolute": "/etc",
+		"escape":   "../../..",
+	} {
+		got, err := os.Readlink(filepath.Join(tmp, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != link {
+			t.Errorf("%s: symbolic link mismatch: want=%q got=%q", name, link, got)
+		}
+	}
+
+	assertReadFile(t, fsys, "etc/one", "1")
+	assertReadFile(t, fsys, "etc/two", "2")
+	assertReadFile(t, fsys, "etc/three", "3")
+	assertReadFile(t, fsys, "etc/four", "4")
+	assertReadFile(t, fsys, "five", "1")
+
+	entries, err := os.ReadDir(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("files were extracted outside of the target directory: %v", entries)
+	}
+}
+
+func TestExtractHardLinks(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	writer := tar.NewWriter(buffer)
+	writeLink(t, writer, "b", "a")
+	writeLink(t, writer, "c", "./b")
+	writeLink(t, writer, "d", "a")
+	writeFile(t, writer, "a", "hello", 0644)
+	writeSymlink(t, writer, "s", "a")
+	writeLink(t, writer, "s2", "s")
+	writeBlock(t, writer, "dev/sda")
+	writeLink(t, writer, "sda", "dev/sda")
+	closeArchive(t, writer)
+
+	tmp := t.TempDir()
+	if err := tarfs.Extract(tmp, tar.NewReader(buffer)); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := os.DirFS(tmp)
+	for _, name := range []string{"a", "b", "c", "d", "s2"} {
+		assertReadFile(t, fsys, name, "hello")
+	}
+
+	link, err := os.Readlink(filepath.Join(tmp, "s2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "a" {
+		t.Errorf("symbolic link mismatch: want=%q got=%q", "a", link)
+	}
+
+	if _, err := os.Lstat(filepath.Join(tmp, "sda")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("error mismatch: want=%v got=%v", fs.ErrNotExist, err)
+	}
+}
@@ -1,35 +1,51 @@
 package tarfs
 
 import (
-	"archive/tar"
 	"io"
 	"io/fs"
 	"sync"
 )
 
 type file struct {
-	header *tar.Header
-	offset int64
+	meta
+	offset int64         // offset of the file data in the tarball
+	sparse []sparseEntry // nil if the file is not sparse
+	ino    uint64        // assigned when building the file system
+	nlink  uint64        // number of entries referencing the file
 }
 
-func (f *file) openFile(fileSystem *fileSystem, header *tar.Header) *openFile {
-	return &openFile{
-		header: header,
-		reader: io.NewSectionReader(fileSystem.data, f.offset, f.header.Size),
+func (f *file) openFile(info fs.FileInfo) *openFile {
+	var reader *io.SectionReader
+	if f.sparse != nil {
+		reader = io.NewSectionReader(&sparseReader{
+			data:   f.data,
+			offset: f.offset,
+			size:   f.size,
+			sparse: f.sparse,
+		}, 0, f.size)
+	} else {
+		reader = io.NewSectionReader(f.data, f.offset, f.size)
 	}
+	return &openFile{info: info, reader: reader}
 }
 
-func (f *file) open(fileSystem *fileSystem) (fs.File, error) {
-	return f.openFile(fileSystem, f.header), nil
+func (f *file) open(n *node) (fs.File, error) {
+	return f.openFile(f.stat(n)), nil
 }
 
-func (f *file) stat() fs.FileInfo {
-	return f.header.FileInfo()
+func (f *file) stat(n *node) fs.FileInfo {
+	return f.info(n, &f.meta)
+}
+
+// info returns the FileInfo of an entry referencing the file, which is either
+// the file itself or a hard link to it.
+func (f *file) info(n *node, m *meta) fs.FileInfo {
+	return fileInfo{node: n, meta: m, size: f.size, ino: f.ino, nlink: f.nlink}
 }
 
 type openFile struct {
 	mutex  sync.RWMutex
-	header *tar.Header
+	info   fs.FileInfo
 	reader *io.SectionReader
 }
 
@@ -68,7 +84,7 @@ func (f *openFile) Close() error {
 }
 
 func (f *openFile) Stat() (fs.FileInfo, error) {
-	return f.header.FileInfo(), nil
+	return f.info, nil
 }
 
 var (
@@ -0,0 +1,414 @@
+package tarfs
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"math"
+	"sort"
+	"sync"
+)
+
+const (
+	// Distance between checkpoints of the gzip index, in bytes of
+	// uncompressed data. Larger values reduce the memory footprint of the
+	// index but increase the cost of random reads, since on average half
+	// of it must be decompressed to serve each read.
+	gzipIndexSpan = 2 * 1024 * 1024
+	// Maximum number of idle decompressors retained by a gzip file to serve
+	// sequential reads without going back to a checkpoint.
+	gzipMaxIdleReaders = 8
+
+	gzipID1     = 0x1f
+	gzipID2     = 0x8b
+	gzipDeflate = 8
+
+	flagText    = 1 << 0
+	flagHdrCrc  = 1 << 1
+	flagExtra   = 1 << 2
+	flagName    = 1 << 3
+	flagComment = 1 << 4
+)
+
+var (
+	errSeekBackward = errors.New("tarfs: cannot seek backward in gzip stream")
+)
+
+func isGzip(data io.ReaderAt, size int64) bool {
+	var magic [2]byte
+	if size < int64(len(magic)) {
+		return false
+	}
+	if _, err := data.ReadAt(magic[:], 0); err != nil {
+		return false
+	}
+	return magic[0] == gzipID1 && magic[1] == gzipID2
+}
+
+// gzipCheckpoint records the state of the decompressor at a position of the
+// stream where decompression can be resumed.
+type gzipCheckpoint struct {
+	in     int64  // bit offset in the compressed stream
+	out    int64  // byte offset in the uncompressed stream
+	member bool   // whether in is the start of a gzip member header
+	window []byte // compressed window preceding out
+}
+
+// gzipReader decompresses a gzip stream made of one or more members, starting
+// either at the beginning of the stream or at a checkpoint.
+type gzipReader struct {
+	br       bitReader
+	inflater inflater
+	toRead   []byte
+	pos      int64
+	err      error
+	inMember bool
+	members  int
+	verify   bool
+	digest   uint32
+	size     uint32
+	// onMember is called before reading the header of each gzip member.
+	onMember func(*gzipReader)
+}
+
+func newGzipReader(data io.ReaderAt, size int64) *gzipReader {
+	z := &gzipReader{verify: true}
+	z.br.reset(io.NewSectionReader(data, 0, size), 0)
+	return z
+}
+
+func (z *gzipReader) resume(data io.ReaderAt, size int64, cp *gzipCheckpoint) error {
+	offset := cp.in / 8
+	z.br.reset(io.NewSectionReader(data, offset, size-offset), offset)
+	z.inflater.out = cp.out
+	z.toRead = nil
+	z.pos = cp.out
+	z.err = nil
+	z.inMember = !cp.member
+	z.members = 1
+	z.verify = false
+
+	if z.inMember {
+		if err := z.br.skipBits(uint(cp.in % 8)); err != nil {
+			return err
+		}
+		window, err := io.ReadAll(flate.NewReader(bytes.NewReader(cp.window)))
+		if err != nil {
+			return err
+		}
+		z.inflater.reset(&z.br, window)
+	}
+	return nil
+}
+
+func (z *gzipReader) Read(b []byte) (int, error) {
+	for len(z.toRead) == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.err = z.step()
+	}
+	n := copy(b, z.toRead)
+	z.toRead = z.toRead[n:]
+	z.pos += int64(n)
+	return n, nil
+}
+
+// Seek only supports skipping forward, which is enough to let tar.Reader skip
+// over the content of files while building the index.
+func (z *gzipReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		offset -= z.pos
+	case io.SeekCurrent:
+	default:
+		return z.pos, errSeekBackward
+	}
+	if offset < 0 {
+		return z.pos, errSeekBackward
+	}
+	err := z.discard(offset)
+	return z.pos, err
+}
+
+func (z *gzipReader) discard(n int64) error {
+	for n > 0 {
+		if len(z.toRead) == 0 {
+			if z.err != nil {
+				return noEOF(z.err)
+			}
+			z.err = z.step()
+			continue
+		}
+		k := int64(len(z.toRead))
+		if k > n {
+			k = n
+		}
+		z.toRead = z.toRead[k:]
+		z.pos += k
+		n -= k
+	}
+	return nil
+}
+
+func (z *gzipReader) step() error {
+	if !z.inMember {
+		if err := z.readHeader(); err != nil {
+			return err
+		}
+	}
+	err := z.inflater.step()
+	b := z.inflater.flush()
+	if z.verify {
+		z.digest = crc32.Update(z.digest, crc32.IEEETable, b)
+		z.size += uint32(len(b))
+	}
+	z.toRead = b
+	if err == io.EOF {
+		err = z.readTrailer()
+	}
+	return err
+}
+
+func (z *gzipReader) readHeader() error {
+	if z.members > 0 {
+		// Concatenated gzip members form a single stream, the end of
+		// the data after a member is the end of the stream.
+		if z.br.nbits == 0 {
+			if _, err := z.br.r.Peek(1); err != nil {
+				return err
+			}
+		}
+	}
+	if z.onMember != nil {
+		z.onMember(z)
+	}
+
+	var header [10]byte
+	if _, err := io.ReadFull(&z.br, header[:]); err != nil {
+		return err
+	}
+	if header[0] != gzipID1 || header[1] != gzipID2 || header[2] != gzipDeflate {
+		return gzip.ErrHeader
+	}
+	flags := header[3]
+
+	if flags&flagExtra != 0 {
+		if _, err := io.ReadFull(&z.br, header[:2]); err != nil {
+			return err
+		}
+		n := int64(header[0]) | int64(header[1])<<8
+		if _, err := io.CopyN(io.Discard, &z.br, n); err != nil {
+			return noEOF(err)
+		}
+	}
+	for _, flag := range []byte{flagName, flagComment} {
+		if flags&flag != 0 {
+			for {
+				c, err := z.br.readByte()
+				if err != nil {
+					return noEOF(err)
+				}
+				if c == 0 {
+					break
+				}
+			}
+		}
+	}
+	if flags&flagHdrCrc != 0 {
+		if _, err := io.ReadFull(&z.br, header[:2]); err != nil {
+			return err
+		}
+	}
+
+	z.inflater.reset(&z.br, nil)
+	z.inMember = true
+	z.members++
+	z.digest = 0
+	z.size = 0
+	return nil
+}
+
+func (z *gzipReader) readTrailer() error {
+	var trailer [8]byte
+	z.br.alignToByte()
+	if _, err := io.ReadFull(&z.br, trailer[:]); err != nil {
+		return err
+	}
+	if z.verify {
+		digest := uint32(trailer[0]) | uint32(trailer[1])<<8 | uint32(trailer[2])<<16 | uint32(trailer[3])<<24
+		size := uint32(trailer[4]) | uint32(trailer[5])<<8 | uint32(trailer[6])<<16 | uint32(trailer[7])<<24
+		if digest != z.digest || size != z.size {
+			return gzip.ErrChecksum
+		}
+	}
+	z.inMember = false
+	return nil
+}
+
+// gzipIndexer wraps the reader used to scan a gzip stream sequentially and
+// records checkpoints along the way.
+type gzipIndexer struct {
+	*gzipReader
+	file       *gzipFile
+	buffer     bytes.Buffer
+	window     []byte
+	compressor *flate.Writer
+}
+
+func newGzipIndexer(data io.ReaderAt, size int64) *gzipIndexer {
+	x := &gzipIndexer{
+		gzipReader: newGzipReader(data, size),
+		file:       &gzipFile{data: data, size: size, length: math.MaxInt64},
+	}
+	x.onMember = x.checkpointMember
+	x.inflater.onBlock = x.checkpointBlock
+	return x
+}
+
+func (x *gzipIndexer) due(out int64) bool {
+	n := len(x.file.checkpoints)
+	return n == 0 || out-x.file.checkpoints[n-1].out >= gzipIndexSpan
+}
+
+// checkpoint adds a checkpoint to the index, which may be concurrently used to
+// read the file when the tarball is scanned lazily.
+func (x *gzipIndexer) checkpoint(cp gzipCheckpoint) {
+	x.file.mutex.Lock()
+	x.file.checkpoints = append(x.file.checkpoints, cp)
+	x.file.mutex.Unlock()
+}
+
+func (x *gzipIndexer) checkpointMember(z *gzipReader) {
+	if out := z.inflater.position(); x.due(out) {
+		x.checkpoint(gzipCheckpoint{
+			in:     z.br.bitOffset(),
+			out:    out,
+			member: true,
+		})
+	}
+}
+
+func (x *gzipIndexer) checkpointBlock(f *inflater) {
+	if out := f.position(); x.due(out) {
+		x.window = f.win.appendDict(x.window[:0])
+		x.buffer.Reset()
+		if x.compressor == nil {
+			x.compressor, _ = flate.NewWriter(&x.buffer, flate.BestSpeed)
+		} else {
+			x.compressor.Reset(&x.buffer)
+		}
+		x.compressor.Write(x.window)
+		x.compressor.Close()
+
+		x.checkpoint(gzipCheckpoint{
+			in:     f.br.bitOffset(),
+			out:    out,
+			window: append([]byte(nil), x.buffer.Bytes()...),
+		})
+	}
+}
+
+// finish consumes the rest of the stream to complete the index of the gzip
+// file. The file can be read before finish returns, but its length is unknown
+// until then, so reads past the end of the stream fail with
+// io.ErrUnexpectedEOF instead of io.EOF.
+func (x *gzipIndexer) finish() error {
+	if _, err := io.Copy(io.Discard, x.gzipReader); err != nil {
+		return err
+	}
+	x.file.mutex.Lock()
+	x.file.length = x.pos
+	x.file.mutex.Unlock()
+	return nil
+}
+
+// gzipFile implements io.ReaderAt on the uncompressed content of a gzip stream
+// by resuming decompression from the nearest checkpoint preceding each read.
+type gzipFile struct {
+	data io.ReaderAt
+	size int64
+
+	mutex       sync.Mutex
+	length      int64
+	checkpoints []gzipCheckpoint
+	readers     []*gzipReader
+}
+
+func (f *gzipFile) ReadAt(b []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+	f.mutex.Lock()
+	length := f.length
+	f.mutex.Unlock()
+
+	if offset >= length {
+		return 0, io.EOF
+	}
+	var eof error
+	if n := length - offset; n < int64(len(b)) {
+		b, eof = b[:n], io.EOF
+	}
+
+	z, err := f.acquire(offset)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(z, b)
+	if err != nil {
+		return n, noEOF(err)
+	}
+	f.release(z)
+	return n, eof
+}
+
+func (f *gzipFile) acquire(offset int64) (*gzipReader, error) {
+	f.mutex.Lock()
+	i := sort.Search(len(f.checkpoints), func(i int) bool {
+		return f.checkpoints[i].out > offset
+	})
+	cp := &f.checkpoints[i-1]
+
+	var z *gzipReader
+	var j int
+	for k, r := range f.readers {
+		if r.pos <= offset && r.pos >= cp.out && (z == nil || r.pos > z.pos) {
+			z, j = r, k
+		}
+	}
+	if z != nil {
+		f.readers = append(f.readers[:j], f.readers[j+1:]...)
+	}
+	f.mutex.Unlock()
+
+	if z == nil {
+		z = new(gzipReader)
+		if err := z.resume(f.data, f.size, cp); err != nil {
+			return nil, err
+		}
+	}
+	if err := z.discard(offset - z.pos); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+func (f *gzipFile) release(z *gzipReader) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(f.readers) == gzipMaxIdleReaders {
+		copy(f.readers, f.readers[1:])
+		f.readers = f.readers[:len(f.readers)-1]
+	}
+	f.readers = append(f.readers, z)
+}
+
+var (
+	_ io.ReadSeeker = (*gzipReader)(nil)
+	_ io.ReaderAt   = (*gzipFile)(nil)
+)
@@ -0,0 +1,164 @@
+package tarfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stealthrocket/tarfs"
+)
+
+func TestGzip(t *testing.T) {
+	prng := rand.New(rand.NewSource(0))
+	files := map[string][]byte{
+		"empty":  {},
+		"small":  []byte("Hello World!"),
+		"random": randomBytes(prng, 3*1024*1024),
+		"text":   textBytes(prng, 5*1024*1024),
+		"zeros":  make([]byte, 4*1024*1024),
+	}
+	names := []string{"empty", "small", "random", "text", "zeros"}
+
+	buffer := bytes.NewBuffer(nil)
+	writer := tar.NewWriter(buffer)
+	for _, name := range names {
+		writeFile(t, writer, "data/"+name, string(files[name]), 0644)
+	}
+	writeSymlink(t, writer, "link", "data/small")
+	closeArchive(t, writer)
+
+	for _, test := range []struct {
+		scenario string
+		level    int
+		members  int
+	}{
+		{scenario: "no compression", level: gzip.NoCompression, members: 1},
+		{scenario: "best speed", level: gzip.BestSpeed, members: 1},
+		{scenario: "best compression", level: gzip.BestCompression, members: 1},
+		{scenario: "huffman only", level: gzip.HuffmanOnly, members: 1},
+		{scenario: "multiple members", level: gzip.DefaultCompression, members: 7},
+	} {
+		t.Run(test.scenario, func(t *testing.T) {
+			fileSystem := openFS(t, compress(t, buffer.Bytes(), test.level, test.members))
+
+			for _, name := range names {
+				assertReadFile(t, fileSystem, "data/"+name, string(files[name]))
+			}
+
+			for _, name := range names {
+				content := files[name]
+				f, err := fileSystem.Open("data/" + name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r := f.(io.ReaderAt)
+
+				for i := 0; i < 100 && len(content) > 0; i++ {
+					offset := prng.Intn(len(content))
+					length := prng.Intn(64 * 1024)
+					if offset+length > len(content) {
+						length = len(content) - offset
+					}
+					b := make([]byte, length)
+					n, err := r.ReadAt(b, int64(offset))
+					if err != nil && err != io.EOF {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(b[:n], content[offset:offset+length]) {
+						t.Fatalf("content of %s mismatch at offset %d (length=%d)", name, offset, length)
+					}
+				}
+				f.Close()
+			}
+		})
+	}
+
+	t.Run("fstest", func(t *testing.T) {
+		buffer := bytes.NewBuffer(nil)
+		writer := tar.NewWriter(buffer)
+
+		writeFile(t, writer, "file-0", "Hello World!", 0644)
+		writeFile(t, writer, "sub/file-1", "123", 0644)
+		writeLink(t, writer, "sub/link-0", "file-0")
+		writeSymlink(t, writer, "symlink-0", "sub/file-1")
+		closeArchive(t, writer)
+
+		fileSystem := openFS(t, compress(t, buffer.Bytes(), gzip.DefaultCompression, 1))
+
+		if err := fstest.TestFS(fileSystem,
+			"file-0",
+			"sub/file-1",
+			"sub/link-0",
+			"symlink-0",
+		); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("corrupted checksum", func(t *testing.T) {
+		b := compress(t, buffer.Bytes(), gzip.BestSpeed, 1)
+		b[len(b)-5] ^= 0xFF
+		_, err := tarfs.OpenFS(bytes.NewReader(b), int64(len(b)))
+		if err != gzip.ErrChecksum {
+			t.Errorf("error mismatch: want=%v got=%v", gzip.ErrChecksum, err)
+		}
+	})
+
+	t.Run("truncated stream", func(t *testing.T) {
+		b := compress(t, buffer.Bytes(), gzip.BestSpeed, 1)
+		b = b[:len(b)/2]
+		_, err := tarfs.OpenFS(bytes.NewReader(b), int64(len(b)))
+		if err == nil {
+			t.Error("opening a truncated gzip stream did not fail")
+		}
+	})
+}
+
+func compress(t *testing.T, data []byte, level, members int) []byte {
+	t.Helper()
+	buffer := new(bytes.Buffer)
+	chunk := (len(data) + members - 1) / members
+
+	for i := 0; i < members; i++ {
+		z, err := gzip.NewWriterLevel(buffer, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.Name = fmt.Sprintf("member-%d", i)
+		z.Comment = "tarfs"
+		z.Extra = []byte{'t', 'f', 0, 0}
+
+		b := data[i*chunk:]
+		if len(b) > chunk {
+			b = b[:chunk]
+		}
+		if _, err := z.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		if err := z.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buffer.Bytes()
+}
+
+func randomBytes(prng *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	prng.Read(b)
+	return b
+}
+
+func textBytes(prng *rand.Rand, n int) []byte {
+	words := []string{"tar", "file", "system", "gzip", "deflate", "index", "\n", "checkpoint"}
+	b := make([]byte, 0, n)
+	for len(b) < n {
+		b = append(b, words[prng.Intn(len(words))]...)
+		b = append(b, ' ')
+	}
+	return b[:n]
+}
@@ -0,0 +1,50 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"io/fs"
+
+	"github.com/stealthrocket/fsinfo"
+)
+
+// Header returns the tar header of the entry described by info, giving access
+// to metadata that fs.FileInfo does not expose, such as the ownership, extended
+// attributes, or device numbers of the entry. The function returns nil if info
+// does not carry a tar header, e.g. when it was not obtained from a file system
+// opened by this package.
+//
+// Directories which do not have an entry in the tarball have a header
+// synthesized from their permissions and modification time.
+//
+// The file systems only retain the metadata exposed by fs.FileInfo in memory,
+// the header is decoded from the tarball on each call, which may involve
+// decompressing data for compressed tarballs.
+func Header(info fs.FileInfo) *tar.Header {
+	h, _ := info.Sys().(*tar.Header)
+	return h
+}
+
+// Ino returns the inode number of the file described by info, or zero if it is
+// unknown.
+//
+// The fsinfo package only reads inode numbers from *syscall.Stat_t values, but
+// the Sys method of the file systems opened by this package returns the tar
+// header of the entries. The function uses the Ino method of info if it has
+// one, as the FileInfo values of these file systems do, and falls back to
+// fsinfo.Ino otherwise.
+func Ino(info fs.FileInfo) uint64 {
+	if i, ok := info.(interface{ Ino() uint64 }); ok {
+		return i.Ino()
+	}
+	return fsinfo.Ino(info)
+}
+
+// Nlink returns the number of hard links to the file described by info, or 1
+// if it is unknown. Like Ino, the function uses the Nlink method of info if it
+// has one, and falls back to fsinfo.Nlink otherwise.
+func Nlink(info fs.FileInfo) uint64 {
+	if i, ok := info.(interface{ Nlink() uint64 }); ok {
+		return i.Nlink()
+	}
+	return fsinfo.Nlink(info)
+}
@@ -0,0 +1,205 @@
+package tarfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	httpBlockSize  = 64 * 1024
+	httpCacheSize  = 256 // blocks
+	httpRangeUnits = "bytes"
+)
+
+var (
+	// ErrRangeNotSupported is returned by NewHTTPReaderAt when the server does
+	// not support range requests.
+	ErrRangeNotSupported = errors.New("tarfs: server does not support range requests")
+	// ErrRemoteChanged is returned when reading a remote tarball which was
+	// modified since it was opened.
+	ErrRemoteChanged = errors.New("tarfs: remote tarball was modified")
+)
+
+// HTTPReaderAt is an io.ReaderAt reading a remote tarball with HTTP range
+// requests, which can be passed to OpenFS to access the tarball without
+// downloading it: only the blocks containing the headers of the entries and
+// the data of the files that are read are fetched.
+//
+//	r, err := tarfs.NewHTTPReaderAt(http.DefaultClient, url)
+//	if err != nil {
+//		...
+//	}
+//	fsys, err := tarfs.OpenFS(r, r.Size(), tarfs.Lazy())
+//
+// Data is fetched in blocks of 64 KiB, and the most recently used blocks are
+// kept in memory. Concurrent reads of the same blocks share a single request,
+// adjacent blocks missing from the cache are fetched with a single request, and
+// the blocks following sequential reads are fetched ahead of time.
+//
+// When the server returns an ETag for the tarball, requests are made
+// conditional on the tarball not being modified, reads fail with
+// ErrRemoteChanged otherwise.
+type HTTPReaderAt struct {
+	client *http.Client
+	url    string
+	etag   string
+	size   int64
+	cache  *cachedReader
+}
+
+// NewHTTPReaderAt returns a reader for the tarball at url, using client to send
+// the requests. The first block of the tarball is fetched to learn its size and
+// verify that the server supports range requests.
+func NewHTTPReaderAt(client *http.Client, url string) (*HTTPReaderAt, error) {
+	r := &HTTPReaderAt{client: client, url: url}
+
+	res, err := r.get(0, httpBlockSize)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var first []byte
+	contentRange := res.Header.Get("Content-Range")
+	start, end, size, ok := parseContentRange(contentRange)
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		if !ok || start != 0 || end > httpBlockSize {
+			return nil, r.error(fmt.Errorf("invalid Content-Range: %q", contentRange))
+		}
+		first = make([]byte, end)
+		if _, err := io.ReadFull(res.Body, first); err != nil {
+			return nil, r.error(err)
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The tarball is empty, the Content-Range header is "bytes */0".
+		if !ok || size != 0 {
+			return nil, r.error(fmt.Errorf("invalid Content-Range: %q", contentRange))
+		}
+	case http.StatusOK:
+		// Servers may ignore the range of requests for empty resources.
+		if res.ContentLength != 0 {
+			return nil, r.error(ErrRangeNotSupported)
+		}
+		size = 0
+	default:
+		return nil, r.error(fmt.Errorf("%s", res.Status))
+	}
+
+	r.etag = res.Header.Get("ETag")
+	if strings.HasPrefix(r.etag, "W/") {
+		r.etag = "" // weak validators cannot be used with range requests
+	}
+	r.size = size
+	r.cache = newBlockCache(httpBlockSize, httpCacheSize*httpBlockSize).reader(httpBackend{r})
+	if len(first) > 0 {
+		if len(first) != httpBlockSize && int64(len(first)) != size {
+			return nil, r.error(fmt.Errorf("invalid Content-Range: %q", contentRange))
+		}
+		r.cache.insert(0, first)
+	}
+	return r, nil
+}
+
+// Size returns the size of the remote tarball.
+func (r *HTTPReaderAt) Size() int64 {
+	return r.size
+}
+
+func (r *HTTPReaderAt) ReadAt(b []byte, offset int64) (int, error) {
+	return r.cache.ReadAt(b, offset)
+}
+
+// httpBackend reads the remote tarball with range requests, it is the backend
+// of the block cache of HTTPReaderAt.
+type httpBackend struct{ *HTTPReaderAt }
+
+func (r httpBackend) ReadAt(b []byte, offset int64) (int, error) {
+	if offset >= r.size {
+		return 0, io.EOF
+	}
+	if n := r.size - offset; n < int64(len(b)) {
+		if err := r.fetch(b[:n], offset); err != nil {
+			return 0, err
+		}
+		return int(n), io.EOF
+	}
+	if err := r.fetch(b, offset); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (r *HTTPReaderAt) fetch(b []byte, offset int64) error {
+	res, err := r.get(offset, int64(len(b)))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusPreconditionFailed:
+		return r.error(ErrRemoteChanged)
+	default:
+		return r.error(fmt.Errorf("%s", res.Status))
+	}
+	contentRange := res.Header.Get("Content-Range")
+	start, end, _, ok := parseContentRange(contentRange)
+	if !ok || start != offset || end != offset+int64(len(b)) {
+		return r.error(fmt.Errorf("invalid Content-Range: %q", contentRange))
+	}
+	if _, err := io.ReadFull(res.Body, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return r.error(err)
+	}
+	return nil
+}
+
+func (r *HTTPReaderAt) get(offset, length int64) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("%s=%d-%d", httpRangeUnits, offset, offset+length-1))
+	if r.etag != "" {
+		req.Header.Set("If-Match", r.etag)
+	}
+	return r.client.Do(req)
+}
+
+func (r *HTTPReaderAt) error(err error) error {
+	return fmt.Errorf("GET %s: %w", r.url, err)
+}
+
+// parseContentRange parses the value of a Content-Range header, returning the
+// start and end (exclusive) of the range, and the complete size of the
+// resource. Unsatisfied ranges ("bytes */size") are returned as empty ranges.
+func parseContentRange(value string) (start, end, size int64, ok bool) {
+	units, value, _ := strings.Cut(value, " ")
+	byteRange, total, _ := strings.Cut(value, "/")
+	size, err := strconv.ParseInt(total, 10, 64)
+	if units != httpRangeUnits || err != nil || size < 0 {
+		return 0, 0, 0, false
+	}
+	if byteRange == "*" {
+		return 0, 0, size, true
+	}
+	first, last, _ := strings.Cut(byteRange, "-")
+	start, err1 := strconv.ParseInt(first, 10, 64)
+	end, err2 := strconv.ParseInt(last, 10, 64)
+	if end++; err1 != nil || err2 != nil || start < 0 || start >= end || end > size {
+		return 0, 0, 0, false
+	}
+	return start, end, size, true
+}
+
+var (
+	_ io.ReaderAt = (*HTTPReaderAt)(nil)
+)
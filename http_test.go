@@ -0,0 +1,184 @@
+package tarfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stealthrocket/tarfs"
+)
+
+func TestHTTPReaderAt(t *testing.T) {
+	const numFiles, fileSize = 16, 1 << 20
+
+	buffer := bytes.NewBuffer(nil)
+	writer := tar.NewWriter(buffer)
+	prng := rand.New(rand.NewSource(0))
+	blobs := make([]string, numFiles)
+	for i := range blobs {
+		blobs[i] = string(randomBytes(prng, fileSize))
+		writeFile(t, writer, fmt.Sprintf("blobs/blob-%d", i), blobs[i], 0644)
+		writeFile(t, writer, fmt.Sprintf("files/file-%d", i), fmt.Sprint(i), 0644)
+	}
+	closeArchive(t, writer)
+	archive := buffer.Bytes()
+
+	t.Run("fetch on demand", func(t *testing.T) {
+		server := newRangeServer(archive)
+		defer server.Close()
+
+		r, err := tarfs.NewHTTPReaderAt(server.Client(), server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Size() != int64(len(archive)) {
+			t.Fatalf("size mismatch: want=%d got=%d", len(archive), r.Size())
+		}
+		fileSystem, err := tarfs.OpenFS(r, r.Size())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < numFiles; i++ {
+			assertReadFile(t, fileSystem, fmt.Sprintf("files/file-%d", i), fmt.Sprint(i))
+		}
+		if n := server.bytes.Load(); n > int64(len(archive))/4 {
+			t.Errorf("fetched too much data: %d/%d", n, len(archive))
+		}
+
+		assertReadFile(t, fileSystem, "blobs/blob-3", blobs[3])
+		assertReadFile(t, fileSystem, "blobs/blob-3", blobs[3])
+		if n := server.bytes.Load(); n > int64(len(archive))/2 {
+			t.Errorf("fetched too much data: %d/%d", n, len(archive))
+		}
+	})
+
+	t.Run("request coalescing", func(t *testing.T) {
+		server := newRangeServer(archive)
+		defer server.Close()
+
+		r, err := tarfs.NewHTTPReaderAt(server.Client(), server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				b := make([]byte, fileSize)
+				if _, err := r.ReadAt(b, 1<<20); err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(b, archive[1<<20:2<<20]) {
+					t.Error("content mismatch")
+				}
+			}()
+		}
+		wg.Wait()
+
+		// One request to open the reader, and one for the blocks read.
+		if n := server.requests.Load(); n != 2 {
+			t.Errorf("wrong number of requests: want=2 got=%d", n)
+		}
+	})
+
+	t.Run("read past the end", func(t *testing.T) {
+		server := newRangeServer(archive)
+		defer server.Close()
+
+		r, err := tarfs.NewHTTPReaderAt(server.Client(), server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 1000)
+		n, err := r.ReadAt(b, int64(len(archive)-10))
+		if n != 10 || err != io.EOF {
+			t.Errorf("wrong result: n=%d err=%v", n, err)
+		}
+		if !bytes.Equal(b[:n], archive[len(archive)-10:]) {
+			t.Error("content mismatch")
+		}
+	})
+
+	t.Run("modified tarball", func(t *testing.T) {
+		server := newRangeServer(archive)
+		defer server.Close()
+
+		r, err := tarfs.NewHTTPReaderAt(server.Client(), server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.etag.Store(`"modified"`)
+		_, err = r.ReadAt(make([]byte, 10), 1<<20)
+		if !errors.Is(err, tarfs.ErrRemoteChanged) {
+			t.Errorf("error mismatch: want=%v got=%v", tarfs.ErrRemoteChanged, err)
+		}
+	})
+
+	t.Run("range not supported", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(archive)
+		}))
+		defer server.Close()
+
+		_, err := tarfs.NewHTTPReaderAt(server.Client(), server.URL)
+		if !errors.Is(err, tarfs.ErrRangeNotSupported) {
+			t.Errorf("error mismatch: want=%v got=%v", tarfs.ErrRangeNotSupported, err)
+		}
+	})
+
+	t.Run("empty tarball", func(t *testing.T) {
+		server := newRangeServer(nil)
+		defer server.Close()
+
+		r, err := tarfs.NewHTTPReaderAt(server.Client(), server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Size() != 0 {
+			t.Errorf("size mismatch: want=0 got=%d", r.Size())
+		}
+	})
+}
+
+// rangeServer serves a tarball with support for range requests, counting the
+// requests and the bytes sent.
+type rangeServer struct {
+	*httptest.Server
+	etag     atomic.Value
+	requests atomic.Int64
+	bytes    atomic.Int64
+}
+
+func newRangeServer(data []byte) *rangeServer {
+	s := &rangeServer{}
+	s.etag.Store(`"tarball"`)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		w.Header().Set("ETag", s.etag.Load().(string))
+		http.ServeContent(countingWriter{w, &s.bytes}, r, "layer.tar", time.Time{}, bytes.NewReader(data))
+	}))
+	return s
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+func (w countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,384 @@
+package tarfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotImage is returned by OpenImage when the file system it is given
+	// is neither an OCI image layout nor an archive created by docker save.
+	ErrNotImage = errors.New("tarfs: not an OCI image layout or docker archive")
+	// ErrNoManifest is returned by OpenImage when the image has no manifest
+	// for the requested platform.
+	ErrNoManifest = errors.New("tarfs: no image manifest matches the platform")
+)
+
+const (
+	mediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// Image is a container image opened by OpenImage.
+type Image struct {
+	// The root file system of the image, obtained by merging all its layers.
+	FS fs.FS
+	// The configuration of the image.
+	Config ImageConfig
+	// The raw JSON representation of the image configuration, which contains
+	// fields that may not be exposed in Config.
+	RawConfig []byte
+
+	layers []fs.File
+}
+
+// Close closes the layer files of the image. The file system of the image must
+// not be used after closing it.
+func (img *Image) Close() error {
+	var lastErr error
+	for _, f := range img.layers {
+		if err := f.Close(); err != nil {
+			lastErr = err
+		}
+	}
+	img.layers = nil
+	return lastErr
+}
+
+// ImageConfig is the configuration of a container image, as defined by the
+// OCI image specification.
+type ImageConfig struct {
+	Created      *time.Time      `json:"created,omitempty"`
+	Author       string          `json:"author,omitempty"`
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	Variant      string          `json:"variant,omitempty"`
+	Config       ContainerConfig `json:"config"`
+	RootFS       RootFS          `json:"rootfs"`
+}
+
+// ContainerConfig holds the execution parameters of a container image.
+type ContainerConfig struct {
+	User         string              `json:"User,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Volumes      map[string]struct{} `json:"Volumes,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	StopSignal   string              `json:"StopSignal,omitempty"`
+}
+
+// RootFS references the layer content addresses of an image.
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+type descriptor struct {
+	MediaType string       `json:"mediaType"`
+	Digest    string       `json:"digest"`
+	Size      int64        `json:"size"`
+	Platform  *ociPlatform `json:"platform,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func parsePlatform(s string) (p ociPlatform, err error) {
+	parts := strings.Split(s, "/")
+	switch len(parts) {
+	case 3:
+		p.Variant = parts[2]
+		fallthrough
+	case 2:
+		p.OS, p.Architecture = parts[0], parts[1]
+	default:
+		err = fmt.Errorf("tarfs: malformed platform: %q", s)
+	}
+	return p, err
+}
+
+func (p *ociPlatform) match(q *ociPlatform) bool {
+	return p.OS == q.OS && p.Architecture == q.Architecture && (q.Variant == "" || p.Variant == q.Variant)
+}
+
+type imageIndex struct {
+	Manifests []descriptor `json:"manifests"`
+}
+
+type imageManifest struct {
+	Config descriptor   `json:"config"`
+	Layers []descriptor `json:"layers"`
+}
+
+type dockerManifest struct {
+	Config string   `json:"Config"`
+	Layers []string `json:"Layers"`
+}
+
+// OpenImage opens the root file system of a container image stored in layout,
+// which may be either an OCI image layout or the content of an archive created
+// by docker save. Both formats can be opened from a directory using os.DirFS,
+// or directly from a tarball using OpenFS.
+//
+// The platform argument selects the image manifest when the layout contains
+// images for multiple platforms, it has the form "os/arch" or
+// "os/arch/variant" (e.g. "linux/arm64/v8"). When empty, the first manifest
+// is selected.
+//
+// Files of the layout are read through the io.ReaderAt interface, which is
+// implemented by the files of the file systems returned by os.DirFS and OpenFS.
+// The files remain open until the image is closed.
+//
+// The options are applied when opening the layers of the image, see OpenFS.
+func OpenImage(layout fs.FS, platform string, options ...Option) (*Image, error) {
+	var want *ociPlatform
+	if platform != "" {
+		p, err := parsePlatform(platform)
+		if err != nil {
+			return nil, err
+		}
+		want = &p
+	}
+
+	var m *imageFiles
+	var err error
+
+	switch {
+	case exists(layout, "index.json"):
+		m, err = readOCILayout(layout, want)
+	case exists(layout, "manifest.json"):
+		m, err = readDockerArchive(layout, want)
+	default:
+		err = ErrNotImage
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	img := new(Image)
+	img.RawConfig, err = readJSON(layout, m.config, m.configDigest, &img.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	b := newBuilder(options)
+	for _, name := range m.layers {
+		f, err := layout.Open(name)
+		if err != nil {
+			img.Close()
+			return nil, err
+		}
+		img.layers = append(img.layers, f)
+
+		if err := openLayer(b, f, name); err != nil {
+			img.Close()
+			return nil, err
+		}
+	}
+
+	img.FS = b.fileSystem(nil, 0)
+	return img, nil
+}
+
+func openLayer(b *builder, f fs.File, name string) error {
+	r, ok := f.(io.ReaderAt)
+	if !ok {
+		return &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("layer file does not implement io.ReaderAt: %T", f)}
+	}
+	s, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, _, err := b.scan(r, s.Size(), true); err != nil {
+		return &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return nil
+}
+
+// imageFiles is the location of the files making up an image in its layout.
+type imageFiles struct {
+	config       string
+	configDigest string
+	layers       []string
+}
+
+func readOCILayout(layout fs.FS, want *ociPlatform) (*imageFiles, error) {
+	var index imageIndex
+	if _, err := readJSON(layout, "index.json", "", &index); err != nil {
+		return nil, err
+	}
+
+	m, err := selectManifest(layout, index.Manifests, want)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := blobPath(m.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	layers := make([]string, len(m.Layers))
+	for i, layer := range m.Layers {
+		if strings.Contains(layer.MediaType, "zstd") {
+			return nil, fmt.Errorf("tarfs: unsupported layer media type: %s", layer.MediaType)
+		}
+		if layers[i], err = blobPath(layer.Digest); err != nil {
+			return nil, err
+		}
+	}
+	return &imageFiles{config: config, configDigest: m.Config.Digest, layers: layers}, nil
+}
+
+func selectManifest(layout fs.FS, manifests []descriptor, want *ociPlatform) (*imageManifest, error) {
+	for _, desc := range manifests {
+		if p := desc.Platform; p != nil {
+			// Attestation manifests use the "unknown" platform, they do
+			// not describe a root file system.
+			if p.OS == "unknown" || (want != nil && !p.match(want)) {
+				continue
+			}
+		}
+
+		name, err := blobPath(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		switch desc.MediaType {
+		case mediaTypeOCIIndex, mediaTypeDockerList:
+			var index imageIndex
+			if _, err := readJSON(layout, name, desc.Digest, &index); err != nil {
+				return nil, err
+			}
+			m, err := selectManifest(layout, index.Manifests, want)
+			if errors.Is(err, ErrNoManifest) {
+				continue
+			}
+			return m, err
+
+		case mediaTypeOCIManifest, mediaTypeDockerManifest, "":
+			m := new(imageManifest)
+			if _, err := readJSON(layout, name, desc.Digest, m); err != nil {
+				return nil, err
+			}
+			if desc.Platform == nil && want != nil {
+				// Without a platform in the descriptor, the platform of
+				// the image is only known from its configuration.
+				config, err := blobPath(m.Config.Digest)
+				if err != nil {
+					return nil, err
+				}
+				match, err := matchConfig(layout, config, m.Config.Digest, want)
+				if err != nil {
+					return nil, err
+				}
+				if !match {
+					continue
+				}
+			}
+			return m, nil
+		}
+	}
+	return nil, ErrNoManifest
+}
+
+func readDockerArchive(layout fs.FS, want *ociPlatform) (*imageFiles, error) {
+	var manifests []dockerManifest
+	if _, err := readJSON(layout, "manifest.json", "", &manifests); err != nil {
+		return nil, err
+	}
+
+	for _, m := range manifests {
+		if want != nil {
+			match, err := matchConfig(layout, m.Config, "", want)
+			if err != nil {
+				return nil, err
+			}
+			if !match {
+				continue
+			}
+		}
+		for _, name := range m.Layers {
+			if !fs.ValidPath(name) {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+			}
+		}
+		return &imageFiles{config: m.Config, layers: m.Layers}, nil
+	}
+	return nil, ErrNoManifest
+}
+
+// matchConfig returns true if the platform of the image configuration at name
+// matches want.
+func matchConfig(layout fs.FS, name, digest string, want *ociPlatform) (bool, error) {
+	var c ImageConfig
+	if _, err := readJSON(layout, name, digest, &c); err != nil {
+		return false, err
+	}
+	p := &ociPlatform{OS: c.OS, Architecture: c.Architecture, Variant: c.Variant}
+	return p.match(want), nil
+}
+
+// readJSON reads and decodes the JSON file at name, verifying that its content
+// matches the digest if it is not empty.
+func readJSON(layout fs.FS, name, digest string, value any) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	b, err := fs.ReadFile(layout, name)
+	if err != nil {
+		return nil, err
+	}
+	if digest != "" {
+		if err := verifyDigest(b, digest); err != nil {
+			return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+		}
+	}
+	if err := json.Unmarshal(b, value); err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return b, nil
+}
+
+func verifyDigest(b []byte, digest string) error {
+	algorithm, hash, _ := strings.Cut(digest, ":")
+	if algorithm != "sha256" {
+		return nil // only verify the digests that we know how to compute
+	}
+	sum := sha256.Sum256(b)
+	if hex.EncodeToString(sum[:]) != hash {
+		return fmt.Errorf("tarfs: digest mismatch: %s", digest)
+	}
+	return nil
+}
+
+// blobPath returns the location of a blob in an OCI image layout.
+func blobPath(digest string) (string, error) {
+	algorithm, hash, ok := strings.Cut(digest, ":")
+	if !ok || algorithm == "" || hash == "" || strings.ContainsAny(digest, "/\\") {
+		return "", fmt.Errorf("tarfs: malformed digest: %q", digest)
+	}
+	return path.Join("blobs", algorithm, hash), nil
+}
+
+func exists(fsys fs.FS, name string) bool {
+	_, err := fs.Stat(fsys, name)
+	return err == nil
+}
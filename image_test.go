@@ -0,0 +1,218 @@
+package tarfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/stealthrocket/tarfs"
+)
+
+func TestImage(t *testing.T) {
+	base := bytes.NewBuffer(nil)
+	writer := tar.NewWriter(base)
+	writeFile(t, writer, "etc/os-release", "ID=tarfs", 0644)
+	writeFile(t, writer, "tmp/junk", "junk", 0644)
+	closeArchive(t, writer)
+
+	amd64 := bytes.NewBuffer(nil)
+	writer = tar.NewWriter(amd64)
+	writeFile(t, writer, "bin/app", "amd64", 0755)
+	writeFile(t, writer, "tmp/.wh.junk", "", 0644)
+	closeArchive(t, writer)
+
+	arm64 := bytes.NewBuffer(nil)
+	writer = tar.NewWriter(arm64)
+	writeFile(t, writer, "bin/app", "arm64", 0755)
+	closeArchive(t, writer)
+
+	baseLayer := compress(t, base.Bytes(), gzip.BestSpeed, 1)
+	amd64Layer := amd64.Bytes()
+	arm64Layer := compress(t, arm64.Bytes(), gzip.BestSpeed, 1)
+
+	amd64Config := marshalJSON(t, map[string]any{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config":       map[string]any{"Entrypoint": []string{"/bin/app"}},
+	})
+	arm64Config := marshalJSON(t, map[string]any{
+		"architecture": "arm64",
+		"os":           "linux",
+		"variant":      "v8",
+		"config":       map[string]any{"Entrypoint": []string{"/bin/app"}},
+	})
+
+	ociLayout := bytes.NewBuffer(nil)
+	writer = tar.NewWriter(ociLayout)
+	writeFile(t, writer, "oci-layout", `{"imageLayoutVersion":"1.0.0"}`, 0644)
+	amd64Manifest := marshalJSON(t, map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        writeBlob(t, writer, "application/vnd.oci.image.config.v1+json", amd64Config),
+		"layers": []any{
+			writeBlob(t, writer, "application/vnd.oci.image.layer.v1.tar+gzip", baseLayer),
+			writeBlob(t, writer, "application/vnd.oci.image.layer.v1.tar", amd64Layer),
+		},
+	})
+	arm64Manifest := marshalJSON(t, map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        writeBlob(t, writer, "application/vnd.oci.image.config.v1+json", arm64Config),
+		"layers": []any{
+			writeBlob(t, writer, "application/vnd.oci.image.layer.v1.tar+gzip", baseLayer),
+			writeBlob(t, writer, "application/vnd.oci.image.layer.v1.tar+gzip", arm64Layer),
+		},
+	})
+	manifestList := marshalJSON(t, map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.index.v1+json",
+		"manifests": []any{
+			withPlatform(writeBlob(t, writer, "application/vnd.oci.image.manifest.v1+json", amd64Manifest), "linux", "amd64", ""),
+			withPlatform(writeBlob(t, writer, "application/vnd.oci.image.manifest.v1+json", arm64Manifest), "linux", "arm64", "v8"),
+		},
+	})
+	writeFile(t, writer, "index.json", string(marshalJSON(t, map[string]any{
+		"schemaVersion": 2,
+		"manifests": []any{
+			writeBlob(t, writer, "application/vnd.oci.image.index.v1+json", manifestList),
+		},
+	})), 0644)
+	closeArchive(t, writer)
+
+	// Manifests listed without a platform are selected by the platform of
+	// their configuration.
+	ociLayoutNoPlatform := bytes.NewBuffer(nil)
+	writer = tar.NewWriter(ociLayoutNoPlatform)
+	writeFile(t, writer, "oci-layout", `{"imageLayoutVersion":"1.0.0"}`, 0644)
+	writeBlob(t, writer, "application/vnd.oci.image.config.v1+json", amd64Config)
+	writeBlob(t, writer, "application/vnd.oci.image.config.v1+json", arm64Config)
+	writeBlob(t, writer, "application/vnd.oci.image.layer.v1.tar+gzip", baseLayer)
+	writeBlob(t, writer, "application/vnd.oci.image.layer.v1.tar", amd64Layer)
+	writeBlob(t, writer, "application/vnd.oci.image.layer.v1.tar+gzip", arm64Layer)
+	writeFile(t, writer, "index.json", string(marshalJSON(t, map[string]any{
+		"schemaVersion": 2,
+		"manifests": []any{
+			writeBlob(t, writer, "application/vnd.oci.image.manifest.v1+json", amd64Manifest),
+			writeBlob(t, writer, "application/vnd.oci.image.manifest.v1+json", arm64Manifest),
+		},
+	})), 0644)
+	closeArchive(t, writer)
+
+	dockerArchive := bytes.NewBuffer(nil)
+	writer = tar.NewWriter(dockerArchive)
+	writeFile(t, writer, "config.json", string(amd64Config), 0644)
+	writeFile(t, writer, "0/layer.tar", string(baseLayer), 0644)
+	writeFile(t, writer, "1/layer.tar", string(amd64Layer), 0644)
+	writeFile(t, writer, "manifest.json", string(marshalJSON(t, []any{
+		map[string]any{
+			"Config":   "config.json",
+			"RepoTags": []string{"tarfs:latest"},
+			"Layers":   []string{"0/layer.tar", "1/layer.tar"},
+		},
+	})), 0644)
+	closeArchive(t, writer)
+
+	for _, test := range []struct {
+		scenario string
+		layout   []byte
+		platform string
+		arch     string
+	}{
+		{scenario: "oci layout", layout: ociLayout.Bytes(), platform: "", arch: "amd64"},
+		{scenario: "oci layout with platform", layout: ociLayout.Bytes(), platform: "linux/arm64", arch: "arm64"},
+		{scenario: "oci layout with variant", layout: ociLayout.Bytes(), platform: "linux/arm64/v8", arch: "arm64"},
+		{scenario: "oci layout without platform", layout: ociLayoutNoPlatform.Bytes(), platform: "", arch: "amd64"},
+		{scenario: "oci layout with platform in config", layout: ociLayoutNoPlatform.Bytes(), platform: "linux/arm64", arch: "arm64"},
+		{scenario: "docker archive", layout: dockerArchive.Bytes(), platform: "", arch: "amd64"},
+		{scenario: "docker archive with platform", layout: dockerArchive.Bytes(), platform: "linux/amd64", arch: "amd64"},
+	} {
+		t.Run(test.scenario, func(t *testing.T) {
+			t.Run("tarball", func(t *testing.T) {
+				assertImage(t, openFS(t, test.layout), test.platform, test.arch)
+			})
+
+			t.Run("directory", func(t *testing.T) {
+				tmp := t.TempDir()
+				if err := tarfs.Extract(tmp, tar.NewReader(bytes.NewReader(test.layout))); err != nil {
+					t.Fatal(err)
+				}
+				assertImage(t, os.DirFS(tmp), test.platform, test.arch)
+			})
+		})
+	}
+
+	t.Run("no matching platform", func(t *testing.T) {
+		for _, layout := range [][]byte{ociLayout.Bytes(), ociLayoutNoPlatform.Bytes(), dockerArchive.Bytes()} {
+			_, err := tarfs.OpenImage(openFS(t, layout), "linux/riscv64")
+			if !errors.Is(err, tarfs.ErrNoManifest) {
+				t.Errorf("error mismatch: want=%v got=%v", tarfs.ErrNoManifest, err)
+			}
+		}
+	})
+
+	t.Run("not an image", func(t *testing.T) {
+		_, err := tarfs.OpenImage(openFS(t, base.Bytes()), "")
+		if !errors.Is(err, tarfs.ErrNotImage) {
+			t.Errorf("error mismatch: want=%v got=%v", tarfs.ErrNotImage, err)
+		}
+	})
+}
+
+func assertImage(t *testing.T, layout fs.FS, platform, arch string) {
+	t.Helper()
+	img, err := tarfs.OpenImage(layout, platform)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	if img.Config.Architecture != arch {
+		t.Errorf("image architecture mismatch: want=%q got=%q", arch, img.Config.Architecture)
+	}
+	if want := []string{"/bin/app"}; !reflect.DeepEqual(img.Config.Config.Entrypoint, want) {
+		t.Errorf("image entrypoint mismatch: want=%q got=%q", want, img.Config.Config.Entrypoint)
+	}
+
+	assertReadFile(t, img.FS, "etc/os-release", "ID=tarfs")
+	assertReadFile(t, img.FS, "bin/app", arch)
+
+	if arch == "amd64" {
+		assertReadDir(t, img.FS, "tmp")
+	} else {
+		assertReadDir(t, img.FS, "tmp", "junk")
+	}
+}
+
+func writeBlob(t *testing.T, w *tar.Writer, mediaType string, content []byte) map[string]any {
+	t.Helper()
+	sum := sha256.Sum256(content)
+	digest := hex.EncodeToString(sum[:])
+	writeFile(t, w, "blobs/sha256/"+digest, string(content), 0644)
+	return map[string]any{
+		"mediaType": mediaType,
+		"digest":    "sha256:" + digest,
+		"size":      len(content),
+	}
+}
+
+func withPlatform(desc map[string]any, os, arch, variant string) map[string]any {
+	desc["platform"] = map[string]any{"os": os, "architecture": arch, "variant": variant}
+	return desc
+}
+
+func marshalJSON(t *testing.T, value any) []byte {
+	t.Helper()
+	b, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
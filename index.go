@@ -0,0 +1,431 @@
+package tarfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidIndex is returned when attempting to load an index which is
+	// malformed or was written by an unsupported version of the package.
+	ErrInvalidIndex = errors.New("tarfs: invalid index")
+	// ErrStaleIndex is returned when attempting to load an index which does
+	// not match the archive it is loaded with.
+	ErrStaleIndex = errors.New("tarfs: index does not match the archive")
+)
+
+const (
+	indexMagic   = "tarfs\x00ix"
+	indexVersion = 3
+	// Number of file headers sampled to compute the checksum used to verify
+	// that an index matches the archive.
+	indexSamples = 16
+	headerSize   = 512
+)
+
+const (
+	entryDir = iota
+	entryFile
+	entryLink
+	entrySymlink
+	entryDeny
+)
+
+// WriteIndex writes to w a compact binary representation of the index built
+// when opening fsys, which must be a file system returned by OpenFS or
+// OpenFSWithIndex. File systems opened with the Lazy option are scanned to the
+// end before writing the index.
+//
+// The index can later be passed to OpenFSWithIndex to open the same archive
+// without scanning all its headers.
+func WriteIndex(w io.Writer, fsys fs.FS) error {
+	if lazy, ok := fsys.(*lazyFileSystem); ok {
+		f, err := lazy.fileSystem()
+		if err != nil {
+			return err
+		}
+		fsys = f
+	}
+	f, ok := fsys.(*fileSystem)
+	if !ok || f.data == nil {
+		return &fs.PathError{Op: "index", Path: ".", Err: fs.ErrInvalid}
+	}
+	checksum, err := f.checksum()
+	if err != nil {
+		return err
+	}
+	archiveSize := f.size
+	data := f.data
+	if r, ok := data.(*cachedReader); ok {
+		data = r.data
+	}
+	gz, _ := data.(*gzipFile)
+	if gz != nil {
+		archiveSize = gz.size
+	}
+
+	b := append([]byte{}, indexMagic...)
+	b = binary.AppendUvarint(b, indexVersion)
+	b = binary.AppendUvarint(b, uint64(archiveSize))
+	b = binary.LittleEndian.AppendUint32(b, checksum)
+
+	if gz == nil {
+		b = binary.AppendUvarint(b, 0)
+	} else {
+		b = binary.AppendUvarint(b, uint64(len(gz.checkpoints)))
+		b = binary.AppendUvarint(b, uint64(gz.length))
+		for _, cp := range gz.checkpoints {
+			b = binary.AppendUvarint(b, uint64(cp.in))
+			b = binary.AppendUvarint(b, uint64(cp.out))
+			b = appendBool(b, cp.member)
+			b = appendBytes(b, cp.window)
+		}
+	}
+
+	// Entries are written in the order of the file system tree, which
+	// guarantees that parent directories are always written before their
+	// children. Only the packed metadata of the entries is stored, their
+	// headers are decoded from the archive when needed.
+	var nodes []*node
+	f.root.forEach(func(n *node) {
+		if n != f.root {
+			nodes = append(nodes, n)
+		}
+	})
+
+	b = binary.AppendUvarint(b, uint64(len(nodes)))
+	for _, n := range nodes {
+		switch entry := n.entry.(type) {
+		case *dir:
+			b = append(b, entryDir)
+			b = appendString(b, n.path())
+			b = appendMeta(b, &entry.meta)
+			b = appendBool(b, !entry.implicit())
+		case *file:
+			b = append(b, entryFile)
+			b = appendString(b, n.path())
+			b = appendMeta(b, &entry.meta)
+			b = binary.AppendUvarint(b, uint64(entry.offset))
+			b = appendBool(b, entry.sparse != nil)
+			b = binary.AppendUvarint(b, uint64(len(entry.sparse)))
+			for _, s := range entry.sparse {
+				b = binary.AppendUvarint(b, uint64(s.offset))
+				b = binary.AppendUvarint(b, uint64(s.length))
+			}
+		case *link:
+			b = append(b, entryLink)
+			b = appendString(b, n.path())
+			b = appendMeta(b, &entry.meta)
+			b = appendString(b, entry.linkname)
+		case *symlink:
+			b = append(b, entrySymlink)
+			b = appendString(b, n.path())
+			b = appendMeta(b, &entry.meta)
+			b = appendString(b, entry.linkname)
+		case *deny:
+			b = append(b, entryDeny)
+			b = appendString(b, n.path())
+			b = appendMeta(b, &entry.meta)
+		}
+	}
+
+	b = binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+	_, err = w.Write(b)
+	return err
+}
+
+// OpenFSWithIndex is like OpenFS but instead of scanning the archive, it loads
+// the index previously written by WriteIndex.
+//
+// The function verifies that the index matches the archive by comparing its
+// size and checksums of a sample of headers, returning ErrStaleIndex if they
+// differ.
+//
+// The options should be the same as the ones used to open the file system that
+// the index was written from.
+func OpenFSWithIndex(data io.ReaderAt, size int64, index io.Reader, options ...Option) (fs.FS, error) {
+	raw, err := io.ReadAll(index)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < len(indexMagic)+4 || !strings.HasPrefix(string(raw), indexMagic) {
+		return nil, ErrInvalidIndex
+	}
+	body, sum := raw[:len(raw)-4], raw[len(raw)-4:]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(sum) {
+		return nil, ErrInvalidIndex
+	}
+
+	d := &indexDecoder{b: body[len(indexMagic):]}
+	if d.uvarint() != indexVersion {
+		return nil, ErrInvalidIndex
+	}
+	if d.uvarint() != uint64(size) {
+		return nil, ErrStaleIndex
+	}
+	checksum := d.uint32()
+
+	if n := d.uvarint(); n != 0 {
+		gz := &gzipFile{
+			data:        data,
+			size:        size,
+			length:      int64(d.uvarint()),
+			checkpoints: make([]gzipCheckpoint, 0, d.count(n)),
+		}
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			gz.checkpoints = append(gz.checkpoints, gzipCheckpoint{
+				in:     int64(d.uvarint()),
+				out:    int64(d.uvarint()),
+				member: d.bool(),
+				window: d.bytes(),
+			})
+		}
+		if d.err == nil && !validCheckpoints(gz.checkpoints, gz.length) {
+			return nil, ErrInvalidIndex
+		}
+		data, size = gz, gz.length
+	}
+
+	b := newBuilder(options)
+	data = b.cached(data)
+
+	for n := d.uvarint(); n > 0 && d.err == nil; n-- {
+		var entry fileEntry
+
+		kind, name := d.byte(), d.string()
+		m := d.meta(data, size)
+		switch kind {
+		case entryDir:
+			if !d.bool() {
+				m.data = nil // implicit
+			}
+			entry = &dir{m}
+		case entryFile:
+			file := &file{meta: m, offset: int64(d.uvarint())}
+			if sparse, n := d.bool(), d.uvarint(); sparse && d.err == nil {
+				var fragments []int64
+				for i := uint64(0); i < 2*n && d.err == nil; i++ {
+					fragments = append(fragments, int64(d.uvarint()))
+				}
+				if file.sparse, err = makeSparseMap(fragments, file.size); err != nil {
+					d.fail()
+				}
+			}
+			entry = file
+		case entryLink:
+			entry = &link{meta: m, linkname: d.string()}
+		case entrySymlink:
+			entry = &symlink{meta: m, linkname: d.string()}
+		case entryDeny:
+			entry = &deny{m}
+		default:
+			d.fail()
+		}
+
+		if d.err != nil || !fs.ValidPath(name) || name == "." {
+			return nil, ErrInvalidIndex
+		}
+		if err := b.add(name, entry); err != nil {
+			if _, ok := err.(*LimitError); ok {
+				return nil, err
+			}
+			return nil, ErrInvalidIndex
+		}
+	}
+	if d.err != nil || len(d.b) != 0 {
+		return nil, ErrInvalidIndex
+	}
+	b.resolveLinks()
+
+	fileSystem := b.fileSystem(data, size)
+	c, err := fileSystem.checksum()
+	if err != nil {
+		return nil, err
+	}
+	if c != checksum {
+		return nil, ErrStaleIndex
+	}
+	return fileSystem, nil
+}
+
+// validCheckpoints returns true if the gzip checkpoints loaded from an index
+// can be used to read the uncompressed data: the first checkpoint must be at
+// the start of the data, and the offsets of the checkpoints must increase and
+// be within the uncompressed length.
+func validCheckpoints(checkpoints []gzipCheckpoint, length int64) bool {
+	if len(checkpoints) == 0 || checkpoints[0].out != 0 {
+		return false
+	}
+	for i := 1; i < len(checkpoints); i++ {
+		prev, cp := &checkpoints[i-1], &checkpoints[i]
+		if cp.in <= prev.in || cp.out <= prev.out {
+			return false
+		}
+	}
+	return length >= checkpoints[len(checkpoints)-1].out
+}
+
+// checksum computes a checksum of the first header of the archive and of the
+// headers of a sample of files, which are located in the block that precedes
+// the file data.
+func (f *fileSystem) checksum() (uint32, error) {
+	offsets := []int64{headerSize}
+	f.root.forEach(func(n *node) {
+		if file, ok := n.entry.(*file); ok {
+			offsets = append(offsets, file.offset)
+		}
+	})
+	sort.Slice(offsets, func(i, j int) bool {
+		return offsets[i] < offsets[j]
+	})
+
+	samples := offsets
+	if len(offsets) > indexSamples {
+		samples = make([]int64, indexSamples)
+		for i := range samples {
+			samples[i] = offsets[i*(len(offsets)-1)/(indexSamples-1)]
+		}
+	}
+
+	var block [headerSize]byte
+	var checksum uint32
+	for _, offset := range samples {
+		if offset < headerSize || offset > f.size {
+			return 0, ErrStaleIndex
+		}
+		if _, err := f.data.ReadAt(block[:], offset-headerSize); err != nil {
+			if err == io.EOF {
+				err = ErrStaleIndex
+			}
+			return 0, err
+		}
+		checksum = crc32.Update(checksum, crc32.IEEETable, block[:])
+	}
+	return checksum, nil
+}
+
+func appendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+func appendBytes(b, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendMeta(b []byte, m *meta) []byte {
+	b = binary.AppendUvarint(b, uint64(m.offset))
+	b = binary.AppendVarint(b, m.size)
+	b = binary.AppendUvarint(b, uint64(m.mode))
+	b = binary.AppendVarint(b, m.sec)
+	return binary.AppendUvarint(b, uint64(m.nsec))
+}
+
+type indexDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *indexDecoder) fail() {
+	d.b, d.err = nil, ErrInvalidIndex
+}
+
+func (d *indexDecoder) byte() byte {
+	if len(d.b) == 0 {
+		d.fail()
+		return 0
+	}
+	c := d.b[0]
+	d.b = d.b[1:]
+	return c
+}
+
+func (d *indexDecoder) bool() bool {
+	return d.byte() != 0
+}
+
+func (d *indexDecoder) uint32() uint32 {
+	if len(d.b) < 4 {
+		d.fail()
+		return 0
+	}
+	v := binary.LittleEndian.Uint32(d.b)
+	d.b = d.b[4:]
+	return v
+}
+
+func (d *indexDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *indexDecoder) varint() int64 {
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+// count bounds n by the remaining size of the index, which protects against
+// allocating large amounts of memory when decoding a malformed index.
+func (d *indexDecoder) count(n uint64) int {
+	if n > uint64(len(d.b)) {
+		n = uint64(len(d.b))
+	}
+	return int(n)
+}
+
+func (d *indexDecoder) bytes() []byte {
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.fail()
+		return nil
+	}
+	v := d.b[:n:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *indexDecoder) string() string {
+	return string(d.bytes())
+}
+
+// meta decodes the packed metadata of an entry of the archive read from data,
+// which is size bytes long.
+func (d *indexDecoder) meta(data io.ReaderAt, size int64) meta {
+	m := meta{
+		data:   data,
+		offset: int64(d.uvarint()),
+		size:   d.varint(),
+		mode:   fs.FileMode(d.uvarint()),
+		sec:    d.varint(),
+	}
+	nsec := d.uvarint()
+	if m.offset < 0 || m.offset > size || m.size < 0 || nsec >= uint64(time.Second) {
+		d.fail()
+	}
+	m.nsec = int32(nsec)
+	return m
+}
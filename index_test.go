@@ -0,0 +1,207 @@
+package tarfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stealthrocket/tarfs"
+)
+
+func TestIndex(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	writer := tar.NewWriter(buffer)
+
+	writeFile(t, writer, "file-0", "Hello World!", 0644)
+	writeFile(t, writer, "sub/file-1", "123", 0644)
+	writeFile(t, writer, "sub/file-2", "456", 0600)
+	writeDir(t, writer, "empty")
+	writeLink(t, writer, "sub/link-0", "file-0")
+	writeSymlink(t, writer, "symlink-0", "sub/file-1")
+	if err := writer.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       "pax",
+		Mode:       0644,
+		Size:       3,
+		Uname:      "root",
+		PAXRecords: map[string]string{"SCHILY.xattr.user.tarfs": "yes"},
+		Format:     tar.FormatPAX,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	writer.Write([]byte("pax"))
+	closeArchive(t, writer)
+
+	for _, test := range []struct {
+		scenario string
+		archive  []byte
+	}{
+		{scenario: "tar", archive: buffer.Bytes()},
+		{scenario: "tar.gz", archive: compress(t, buffer.Bytes(), gzip.BestSpeed, 1)},
+	} {
+		t.Run(test.scenario, func(t *testing.T) {
+			index := writeIndex(t, openFS(t, test.archive))
+
+			fileSystem, err := tarfs.OpenFSWithIndex(bytes.NewReader(test.archive), int64(len(test.archive)), bytes.NewReader(index))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := fstest.TestFS(fileSystem,
+				"file-0",
+				"sub/file-1",
+				"sub/file-2",
+				"sub/link-0",
+				"symlink-0",
+				"empty",
+				"pax",
+			); err != nil {
+				t.Fatal(err)
+			}
+			assertReadFile(t, fileSystem, "sub/link-0", "Hello World!")
+			assertReadFile(t, fileSystem, "symlink-0", "123")
+			assertReadFile(t, fileSystem, "pax", "pax")
+
+			if !bytes.Equal(index, writeIndex(t, fileSystem)) {
+				t.Error("index written from a file system opened with an index differs from the original")
+			}
+		})
+	}
+
+	t.Run("stale archive", func(t *testing.T) {
+		archive := buffer.Bytes()
+		index := writeIndex(t, openFS(t, archive))
+
+		modified := append([]byte{}, archive...)
+		copy(modified, "file-9")
+		assertOpenIndexError(t, modified, index, tarfs.ErrStaleIndex)
+
+		truncated := archive[:len(archive)-512]
+		assertOpenIndexError(t, truncated, index, tarfs.ErrStaleIndex)
+	})
+
+	t.Run("corrupted index", func(t *testing.T) {
+		archive := buffer.Bytes()
+		index := writeIndex(t, openFS(t, archive))
+
+		index[len(index)/2] ^= 0xFF
+		assertOpenIndexError(t, archive, index, tarfs.ErrInvalidIndex)
+		assertOpenIndexError(t, archive, index[:10], tarfs.ErrInvalidIndex)
+	})
+
+	t.Run("invalid checkpoints", func(t *testing.T) {
+		buffer := bytes.NewBuffer(nil)
+		writer := tar.NewWriter(buffer)
+		writeFile(t, writer, "zeros", string(make([]byte, 5*1024*1024)), 0644)
+		closeArchive(t, writer)
+
+		// The gzip index has checkpoints every 2 MiB of uncompressed data.
+		archive := compress(t, buffer.Bytes(), gzip.BestSpeed, 1)
+		index := writeIndex(t, openFS(t, archive))
+
+		for _, test := range []struct {
+			scenario string
+			modify   func(length *uint64, checkpoints [][2]uint64)
+		}{
+			{
+				scenario: "first checkpoint after the start",
+				modify: func(length *uint64, checkpoints [][2]uint64) {
+					checkpoints[0][1] = 1
+				},
+			},
+			{
+				scenario: "compressed offsets not increasing",
+				modify: func(length *uint64, checkpoints [][2]uint64) {
+					checkpoints[1][0] = checkpoints[0][0]
+				},
+			},
+			{
+				scenario: "uncompressed offsets not increasing",
+				modify: func(length *uint64, checkpoints [][2]uint64) {
+					checkpoints[1][1] = checkpoints[0][1]
+				},
+			},
+			{
+				scenario: "length before the last checkpoint",
+				modify: func(length *uint64, checkpoints [][2]uint64) {
+					*length = checkpoints[len(checkpoints)-1][1] - 1
+				},
+			},
+		} {
+			t.Run(test.scenario, func(t *testing.T) {
+				modified := rewriteCheckpoints(t, index, test.modify)
+				assertOpenIndexError(t, archive, modified, tarfs.ErrInvalidIndex)
+			})
+		}
+	})
+}
+
+// rewriteCheckpoints decodes the gzip checkpoints of an index, passes their
+// compressed and uncompressed offsets to modify, and returns the index with
+// the modified checkpoints and a valid checksum.
+func rewriteCheckpoints(t *testing.T, index []byte, modify func(*uint64, [][2]uint64)) []byte {
+	t.Helper()
+	b := index[len("tarfs\x00ix"):]
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatal("malformed index")
+		}
+		b = b[n:]
+		return v
+	}
+	uvarint() // version
+	uvarint() // archive size
+	b = b[4:] // checksum
+	prefix := index[:len(index)-len(b)]
+
+	checkpoints := make([][2]uint64, uvarint())
+	if len(checkpoints) < 2 {
+		t.Fatalf("index has too few checkpoints: %d", len(checkpoints))
+	}
+	length := uvarint()
+	windows := make([][]byte, len(checkpoints))
+	for i := range checkpoints {
+		checkpoints[i][0] = uvarint()
+		checkpoints[i][1] = uvarint()
+		// The member flag and window are copied unchanged.
+		start := len(index) - len(b)
+		b = b[1:]
+		b = b[uvarint():]
+		windows[i] = index[start : len(index)-len(b)]
+	}
+	modify(&length, checkpoints)
+
+	out := append([]byte{}, prefix...)
+	out = binary.AppendUvarint(out, uint64(len(checkpoints)))
+	out = binary.AppendUvarint(out, length)
+	for i, cp := range checkpoints {
+		out = binary.AppendUvarint(out, cp[0])
+		out = binary.AppendUvarint(out, cp[1])
+		out = append(out, windows[i]...)
+	}
+	out = append(out, b[:len(b)-4]...)
+	return binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(out))
+}
+
+func writeIndex(t *testing.T, fileSystem fs.FS) []byte {
+	t.Helper()
+	index := new(bytes.Buffer)
+	if err := tarfs.WriteIndex(index, fileSystem); err != nil {
+		t.Fatal(err)
+	}
+	return index.Bytes()
+}
+
+func assertOpenIndexError(t *testing.T, archive, index []byte, want error) {
+	t.Helper()
+	_, err := tarfs.OpenFSWithIndex(bytes.NewReader(archive), int64(len(archive)), bytes.NewReader(index))
+	if !errors.Is(err, want) {
+		t.Errorf("error mismatch: want=%v got=%v", want, err)
+	}
+}
@@ -0,0 +1,607 @@
+package tarfs
+
+import (
+	"bufio"
+	"compress/flate"
+	"io"
+)
+
+// This file contains a DEFLATE decoder (RFC 1951). We cannot use the one from
+// compress/flate because it does not expose the position of block boundaries
+// in the compressed stream, nor does it allow resuming decompression from the
+// middle of a stream, both of which are needed to build a random access index.
+
+const (
+	maxCodeBits = 15
+	windowSize  = 1 << 15
+)
+
+var (
+	lengthBase = [...]uint16{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31,
+		35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258,
+	}
+	lengthExtra = [...]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2,
+		3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0,
+	}
+	distBase = [...]uint16{
+		1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193,
+		257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145,
+		8193, 12289, 16385, 24577,
+	}
+	distExtra = [...]uint8{
+		0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6,
+		7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13,
+	}
+	codeLengthOrder = [...]uint8{
+		16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15,
+	}
+
+	fixedLitLen huffman
+	fixedDist   huffman
+)
+
+func init() {
+	var lengths [288]uint8
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	fixedLitLen.init(lengths[:])
+
+	for i := range lengths[:32] {
+		lengths[i] = 5
+	}
+	fixedDist.init(lengths[:32])
+}
+
+// bitReader reads a compressed stream bit by bit, in the LSB-first order used
+// by DEFLATE, and keeps track of its exact position in the stream.
+type bitReader struct {
+	r      *bufio.Reader
+	offset int64 // byte offset of the next byte read from r
+	bits   uint64
+	nbits  uint
+}
+
+func (br *bitReader) reset(r io.Reader, offset int64) {
+	if br.r == nil {
+		br.r = bufio.NewReader(r)
+	} else {
+		br.r.Reset(r)
+	}
+	br.offset = offset
+	br.bits = 0
+	br.nbits = 0
+}
+
+// bitOffset returns the position of the next bit to be read.
+func (br *bitReader) bitOffset() int64 {
+	return 8*br.offset - int64(br.nbits)
+}
+
+func (br *bitReader) fill(n uint) error {
+	for br.nbits < n {
+		c, err := br.r.ReadByte()
+		if err != nil {
+			return noEOF(err)
+		}
+		br.bits |= uint64(c) << br.nbits
+		br.nbits += 8
+		br.offset++
+	}
+	return nil
+}
+
+func (br *bitReader) readBits(n uint) (uint32, error) {
+	if err := br.fill(n); err != nil {
+		return 0, err
+	}
+	v := uint32(br.bits & (1<<n - 1))
+	br.bits >>= n
+	br.nbits -= n
+	return v, nil
+}
+
+func (br *bitReader) skipBits(n uint) error {
+	_, err := br.readBits(n)
+	return err
+}
+
+func (br *bitReader) alignToByte() {
+	n := br.nbits % 8
+	br.bits >>= n
+	br.nbits -= n
+}
+
+// readByte reads the next byte of the stream, it must only be called when the
+// reader is aligned on a byte boundary.
+func (br *bitReader) readByte() (byte, error) {
+	if br.nbits != 0 {
+		c := byte(br.bits)
+		br.bits >>= 8
+		br.nbits -= 8
+		return c, nil
+	}
+	c, err := br.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	br.offset++
+	return c, nil
+}
+
+// Read reads bytes of the stream into b, it must only be called when the
+// reader is aligned on a byte boundary.
+func (br *bitReader) Read(b []byte) (int, error) {
+	n := 0
+	for n < len(b) && br.nbits != 0 {
+		b[n] = byte(br.bits)
+		br.bits >>= 8
+		br.nbits -= 8
+		n++
+	}
+	if n < len(b) {
+		rn, err := br.r.Read(b[n:])
+		br.offset += int64(rn)
+		n += rn
+		if err != nil {
+			return n, noEOF(err)
+		}
+	}
+	return n, nil
+}
+
+func (br *bitReader) decode(h *huffman) (int, error) {
+	for br.nbits < h.bits {
+		c, err := br.r.ReadByte()
+		if err != nil {
+			// The last code of the stream may be shorter than the
+			// longest code of the table, we only report an error
+			// if the bits we have are not enough to decode it.
+			if e := h.lookup(br.bits); e.size() == 0 || e.size() > br.nbits {
+				return 0, noEOF(err)
+			}
+			break
+		}
+		br.bits |= uint64(c) << br.nbits
+		br.nbits += 8
+		br.offset++
+	}
+	e := h.lookup(br.bits)
+	n := e.size()
+	if n == 0 {
+		return 0, flate.CorruptInputError(br.offset)
+	}
+	br.bits >>= n
+	br.nbits -= n
+	return e.symbol(), nil
+}
+
+// huffman is a lookup table for canonical Huffman codes, indexed by the next
+// bits of the stream.
+type huffman struct {
+	bits  uint
+	table []huffmanEntry
+}
+
+type huffmanEntry uint16
+
+func (e huffmanEntry) size() uint  { return uint(e & 15) }
+func (e huffmanEntry) symbol() int { return int(e >> 4) }
+
+func (h *huffman) lookup(bits uint64) huffmanEntry {
+	if len(h.table) == 0 {
+		return 0
+	}
+	return h.table[bits&(1<<h.bits-1)]
+}
+
+func (h *huffman) init(lengths []uint8) bool {
+	var count [maxCodeBits + 1]int
+	var maxBits uint
+	for _, n := range lengths {
+		count[n]++
+		if uint(n) > maxBits {
+			maxBits = uint(n)
+		}
+	}
+	count[0] = 0
+
+	left := 1
+	for _, n := range count[1:] {
+		left = (left << 1) - n
+		if left < 0 {
+			return false // over-subscribed
+		}
+	}
+
+	var next [maxCodeBits + 1]int
+	code := 0
+	for i := 1; i <= maxCodeBits; i++ {
+		code = (code + count[i-1]) << 1
+		next[i] = code
+	}
+
+	size := 1 << maxBits
+	if cap(h.table) < size {
+		h.table = make([]huffmanEntry, size)
+	} else {
+		h.table = h.table[:size]
+		for i := range h.table {
+			h.table[i] = 0
+		}
+	}
+	h.bits = maxBits
+
+	for sym, n := range lengths {
+		if n == 0 {
+			continue
+		}
+		c := next[n]
+		next[n]++
+		// Codes are packed starting with their most significant bit, but
+		// the stream is read LSB first so the table is indexed by the
+		// reversed code.
+		r := 0
+		for i := uint8(0); i < n; i++ {
+			r = (r << 1) | (c & 1)
+			c >>= 1
+		}
+		for i := r; i < size; i += 1 << n {
+			h.table[i] = huffmanEntry(sym<<4 | int(n))
+		}
+	}
+	return true
+}
+
+// window is the sliding window of the last 32 KiB of decompressed output,
+// which is used both to resolve back references and to buffer the output
+// until it is read.
+type window struct {
+	hist  [windowSize]byte
+	wrPos int
+	rdPos int
+	full  bool
+}
+
+func (w *window) reset(dict []byte) {
+	if len(dict) > windowSize {
+		dict = dict[len(dict)-windowSize:]
+	}
+	w.wrPos = copy(w.hist[:], dict)
+	w.rdPos = w.wrPos
+	w.full = false
+	if w.wrPos == windowSize {
+		w.wrPos, w.rdPos, w.full = 0, 0, true
+	}
+}
+
+func (w *window) histSize() int {
+	if w.full {
+		return windowSize
+	}
+	return w.wrPos
+}
+
+func (w *window) availWrite() int {
+	return windowSize - w.wrPos
+}
+
+func (w *window) writeByte(c byte) {
+	w.hist[w.wrPos] = c
+	w.wrPos++
+}
+
+func (w *window) writeCopy(dist, length int) int {
+	dstBase := w.wrPos
+	dstPos := dstBase
+	srcPos := dstPos - dist
+	endPos := dstPos + length
+	if endPos > windowSize {
+		endPos = windowSize
+	}
+	if srcPos < 0 {
+		srcPos += windowSize
+		dstPos += copy(w.hist[dstPos:endPos], w.hist[srcPos:])
+		srcPos = 0
+	}
+	for dstPos < endPos {
+		dstPos += copy(w.hist[dstPos:endPos], w.hist[srcPos:dstPos])
+	}
+	w.wrPos = dstPos
+	return dstPos - dstBase
+}
+
+func (w *window) readFlush() []byte {
+	b := w.hist[w.rdPos:w.wrPos]
+	w.rdPos = w.wrPos
+	if w.wrPos == windowSize {
+		w.wrPos, w.rdPos, w.full = 0, 0, true
+	}
+	return b
+}
+
+// appendDict appends the content of the window to b, in stream order.
+func (w *window) appendDict(b []byte) []byte {
+	if w.full {
+		b = append(b, w.hist[w.wrPos:]...)
+	}
+	return append(b, w.hist[:w.wrPos]...)
+}
+
+const (
+	stateBlockHeader = iota
+	stateStored
+	stateHuffman
+	stateDone
+)
+
+// inflater decompresses a DEFLATE stream, it may start at any block boundary
+// as long as it is given the window that preceded it.
+type inflater struct {
+	br       *bitReader
+	win      window
+	out      int64 // number of bytes flushed out of the window
+	state    int
+	final    bool
+	stored   int // remaining bytes in stored block
+	copyLen  int
+	copyDist int
+	litLen   *huffman
+	dist     *huffman
+	dynLit   huffman
+	dynDist  huffman
+	codeLens huffman
+	lengths  [286 + 32]uint8
+	// onBlock is called when the inflater reaches a block boundary, before
+	// decoding the header of the next block.
+	onBlock func(*inflater)
+}
+
+// reset prepares the inflater to decode a new stream from br, the dictionary
+// is the window of output preceding the stream, if any.
+func (f *inflater) reset(br *bitReader, dict []byte) {
+	f.br = br
+	f.win.reset(dict)
+	f.state = stateBlockHeader
+	f.final = false
+	f.copyLen = 0
+}
+
+// flush returns the output decoded since the last call to flush.
+func (f *inflater) flush() []byte {
+	b := f.win.readFlush()
+	f.out += int64(len(b))
+	return b
+}
+
+// position returns the offset of the next byte of output.
+func (f *inflater) position() int64 {
+	return f.out + int64(f.win.wrPos-f.win.rdPos)
+}
+
+// step decodes compressed data until the window is full or the end of the
+// stream is reached, returning io.EOF in the latter case.
+func (f *inflater) step() error {
+	for f.win.availWrite() > 0 {
+		var err error
+		switch f.state {
+		case stateBlockHeader:
+			err = f.readBlockHeader()
+		case stateStored:
+			err = f.readStored()
+		case stateHuffman:
+			err = f.readHuffman()
+		default:
+			return io.EOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *inflater) readBlockHeader() error {
+	if f.final {
+		f.state = stateDone
+		return io.EOF
+	}
+	if f.onBlock != nil {
+		f.onBlock(f)
+	}
+
+	header, err := f.br.readBits(3)
+	if err != nil {
+		return err
+	}
+	f.final = header&1 != 0
+
+	switch header >> 1 {
+	case 0:
+		f.br.alignToByte()
+		v, err := f.br.readBits(32)
+		if err != nil {
+			return err
+		}
+		n, nn := uint16(v), uint16(v>>16)
+		if n != ^nn {
+			return flate.CorruptInputError(f.br.offset)
+		}
+		f.stored, f.state = int(n), stateStored
+	case 1:
+		f.litLen, f.dist, f.state = &fixedLitLen, &fixedDist, stateHuffman
+	case 2:
+		if err := f.readDynamicTables(); err != nil {
+			return err
+		}
+		f.litLen, f.dist, f.state = &f.dynLit, &f.dynDist, stateHuffman
+	default:
+		return flate.CorruptInputError(f.br.offset)
+	}
+	return nil
+}
+
+func (f *inflater) readDynamicTables() error {
+	v, err := f.br.readBits(14)
+	if err != nil {
+		return err
+	}
+	nlit := int(v&31) + 257
+	ndist := int(v>>5&31) + 1
+	nclen := int(v>>10) + 4
+	if nlit > 286 || ndist > 30 {
+		return flate.CorruptInputError(f.br.offset)
+	}
+
+	var clens [19]uint8
+	for _, i := range codeLengthOrder[:nclen] {
+		n, err := f.br.readBits(3)
+		if err != nil {
+			return err
+		}
+		clens[i] = uint8(n)
+	}
+	if !f.codeLens.init(clens[:]) {
+		return flate.CorruptInputError(f.br.offset)
+	}
+
+	lengths := f.lengths[:nlit+ndist]
+	for i := 0; i < len(lengths); {
+		sym, err := f.br.decode(&f.codeLens)
+		if err != nil {
+			return err
+		}
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+		var rep uint32
+		var val uint8
+		switch sym {
+		case 16:
+			if i == 0 {
+				return flate.CorruptInputError(f.br.offset)
+			}
+			val = lengths[i-1]
+			rep, err = f.br.readBits(2)
+			rep += 3
+		case 17:
+			rep, err = f.br.readBits(3)
+			rep += 3
+		default:
+			rep, err = f.br.readBits(7)
+			rep += 11
+		}
+		if err != nil {
+			return err
+		}
+		if i+int(rep) > len(lengths) {
+			return flate.CorruptInputError(f.br.offset)
+		}
+		for ; rep > 0; rep-- {
+			lengths[i] = val
+			i++
+		}
+	}
+
+	if lengths[256] == 0 {
+		return flate.CorruptInputError(f.br.offset)
+	}
+	if !f.dynLit.init(lengths[:nlit]) || !f.dynDist.init(lengths[nlit:]) {
+		return flate.CorruptInputError(f.br.offset)
+	}
+	return nil
+}
+
+func (f *inflater) readStored() error {
+	for f.stored > 0 {
+		n := f.win.availWrite()
+		if n == 0 {
+			return nil
+		}
+		if n > f.stored {
+			n = f.stored
+		}
+		n, err := f.br.Read(f.win.hist[f.win.wrPos : f.win.wrPos+n])
+		f.win.wrPos += n
+		f.stored -= n
+		if err != nil {
+			return err
+		}
+	}
+	f.state = stateBlockHeader
+	return nil
+}
+
+func (f *inflater) readHuffman() error {
+	for {
+		if f.copyLen > 0 {
+			n := f.win.writeCopy(f.copyDist, f.copyLen)
+			f.copyLen -= n
+			if f.copyLen > 0 {
+				return nil // window is full
+			}
+		}
+		if f.win.availWrite() == 0 {
+			return nil
+		}
+
+		sym, err := f.br.decode(f.litLen)
+		if err != nil {
+			return err
+		}
+		switch {
+		case sym < 256:
+			f.win.writeByte(byte(sym))
+			continue
+		case sym == 256:
+			f.state = stateBlockHeader
+			return nil
+		case sym > 285:
+			return flate.CorruptInputError(f.br.offset)
+		}
+
+		sym -= 257
+		extra, err := f.br.readBits(uint(lengthExtra[sym]))
+		if err != nil {
+			return err
+		}
+		length := int(lengthBase[sym]) + int(extra)
+
+		sym, err = f.br.decode(f.dist)
+		if err != nil {
+			return err
+		}
+		if sym >= len(distBase) {
+			return flate.CorruptInputError(f.br.offset)
+		}
+		extra, err = f.br.readBits(uint(distExtra[sym]))
+		if err != nil {
+			return err
+		}
+		dist := int(distBase[sym]) + int(extra)
+		if dist > f.win.histSize() {
+			return flate.CorruptInputError(f.br.offset)
+		}
+		f.copyLen, f.copyDist = length, dist
+	}
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,42 @@
+package tarfs
+
+import (
+	"io"
+	"io/fs"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutMeta   = ".wh..wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// Layer represents a tarball used as a layer of a file system opened by
+// OpenLayersFS.
+type Layer struct {
+	Data io.ReaderAt
+	Size int64
+}
+
+// OpenLayersFS opens a file system made of a stack of tarballs, applying each
+// layer on top of the previous ones, similarly to how container images are
+// assembled.
+//
+// When multiple layers contain entries with the same name, the entry from the
+// upper layer takes precedence. Layers may contain OCI whiteout files: a file
+// named ".wh.<name>" hides the entry <name> of the lower layers, and a file
+// named ".wh..wh..opq" hides all the entries of the lower layers in the
+// directory that contains it. Whiteout files are not visible in the returned
+// file system.
+//
+// Like OpenFS, the layers may be compressed with gzip. The content of files is
+// read directly from the layer that they were found in.
+func OpenLayersFS(layers []Layer, options ...Option) (fs.FS, error) {
+	b := newBuilder(options)
+	for _, layer := range layers {
+		if _, _, err := b.scan(layer.Data, layer.Size, true); err != nil {
+			return nil, err
+		}
+	}
+	return b.fileSystem(nil, 0), nil
+}
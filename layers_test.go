@@ -0,0 +1,121 @@
+package tarfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/fs"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stealthrocket/fslink"
+	"github.com/stealthrocket/tarfs"
+)
+
+func TestLayers(t *testing.T) {
+	base := bytes.NewBuffer(nil)
+	writer := tar.NewWriter(base)
+	writeFile(t, writer, "bin/sh", "#!", 0755)
+	writeFile(t, writer, "etc/hosts", "127.0.0.1 localhost", 0644)
+	writeFile(t, writer, "etc/passwd", "root:x:0:0", 0644)
+	writeFile(t, writer, "var/cache/a", "A", 0644)
+	writeFile(t, writer, "var/cache/b", "B", 0644)
+	writeFile(t, writer, "var/log/messages", "hello", 0644)
+	writeFile(t, writer, "opt/app", "v1", 0644)
+	closeArchive(t, writer)
+
+	upper := bytes.NewBuffer(nil)
+	writer = tar.NewWriter(upper)
+	writeFile(t, writer, "etc/.wh.passwd", "", 0644)
+	writeFile(t, writer, "var/cache/.wh..wh..opq", "", 0644)
+	writeFile(t, writer, "var/cache/c", "C", 0644)
+	writeFile(t, writer, "var/.wh.log", "", 0644)
+	writeFile(t, writer, "etc/hosts", "::1 localhost", 0644)
+	writeDir(t, writer, "opt/app")
+	writeFile(t, writer, "opt/app/bin", "v2", 0755)
+	writeFile(t, writer, ".wh..wh.plnk", "", 0644)
+	closeArchive(t, writer)
+
+	top := bytes.NewBuffer(nil)
+	writer = tar.NewWriter(top)
+	writeSymlink(t, writer, "usr/bin/sh", "../../bin/sh")
+	writeLink(t, writer, "etc/hosts.bak", "etc/hosts")
+	writeFile(t, writer, "var/.wh.nothing", "", 0644)
+	closeArchive(t, writer)
+
+	fileSystem, err := tarfs.OpenLayersFS([]tarfs.Layer{
+		layer(base.Bytes()),
+		layer(compress(t, upper.Bytes(), gzip.BestSpeed, 1)),
+		layer(top.Bytes()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fstest.TestFS(fileSystem,
+		"bin/sh",
+		"etc/hosts",
+		"etc/hosts.bak",
+		"var/cache/c",
+		"opt/app/bin",
+		"usr/bin/sh",
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	assertReadFile(t, fileSystem, "etc/hosts", "::1 localhost")
+	assertReadFile(t, fileSystem, "etc/hosts.bak", "::1 localhost")
+	assertReadFile(t, fileSystem, "opt/app/bin", "v2")
+	assertReadFile(t, fileSystem, "usr/bin/sh", "#!")
+	assertReadFile(t, fileSystem, "var/cache/c", "C")
+
+	for _, name := range []string{
+		"etc/passwd",
+		"etc/.wh.passwd",
+		"var/cache/a",
+		"var/cache/b",
+		"var/cache/.wh..wh..opq",
+		"var/log",
+		"var/log/messages",
+		".wh..wh.plnk",
+	} {
+		if _, err := fs.Stat(fileSystem, name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: expected entry to be deleted: %v", name, err)
+		}
+	}
+
+	assertReadDir(t, fileSystem, ".", "bin", "etc", "opt", "usr", "var")
+	assertReadDir(t, fileSystem, "etc", "hosts", "hosts.bak")
+	assertReadDir(t, fileSystem, "var", "cache")
+	assertReadDir(t, fileSystem, "var/cache", "c")
+
+	link, err := fslink.ReadLink(fileSystem, "usr/bin/sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "../../bin/sh" {
+		t.Errorf("symbolic link mismatch: want=%q got=%q", "../../bin/sh", link)
+	}
+}
+
+func layer(b []byte) tarfs.Layer {
+	return tarfs.Layer{Data: bytes.NewReader(b), Size: int64(len(b))}
+}
+
+func assertReadDir(t *testing.T, f fs.FS, name string, want ...string) {
+	t.Helper()
+	entries, err := fs.ReadDir(f, name)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.Name())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("entries of %s mismatch: want=%q got=%q", name, want, got)
+	}
+}
@@ -0,0 +1,226 @@
+package tarfs
+
+import (
+	"io"
+	"io/fs"
+	"sync"
+	"sync/atomic"
+
+	"github.com/stealthrocket/fslink"
+)
+
+// lazyFileSystem is the file system returned by OpenFS when the Lazy option is
+// used. Entries are added to the file system as the tarball is scanned, and the
+// scan only advances when the result of an operation may still be changed by
+// the entries which have not been read yet.
+//
+// Until the scan completes, all operations hold the mutex, which serializes the
+// scan and protects the file system against concurrent modifications; reading
+// the content of files does not need it. The complete file system is immutable
+// and published in loaded, which operations use without holding the mutex.
+type lazyFileSystem struct {
+	mutex   sync.Mutex
+	fs      *fileSystem
+	scanner *scanner
+	err     error
+	done    bool
+	loaded  atomic.Pointer[fileSystem]
+	cache   *blockCache // shared by all the states of fs
+}
+
+func (b *builder) lazyFileSystem(data io.ReaderAt, size int64) *lazyFileSystem {
+	if b.config.duplicates == LastWins {
+		b.config.duplicates = FirstWins
+	}
+	s := b.newScanner(data, size, false)
+	return &lazyFileSystem{
+		fs: &fileSystem{
+			config:      b.config,
+			data:        s.data,
+			root:        b.root,
+			maxSymlinks: b.limiter.maxSymlinks(),
+			cache:       b.cache,
+		},
+		scanner: s,
+		cache:   b.cache,
+	}
+}
+
+func (f *lazyFileSystem) Open(name string) (fs.File, error) {
+	if fsys := f.loaded.Load(); fsys != nil {
+		return fsys.Open(name)
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.scanFor(name, true, true); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return f.fs.Open(name)
+}
+
+func (f *lazyFileSystem) Stat(name string) (fs.FileInfo, error) {
+	if fsys := f.loaded.Load(); fsys != nil {
+		return fsys.Stat(name)
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.scanFor(name, true, false); err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return f.fs.Stat(name)
+}
+
+func (f *lazyFileSystem) Lstat(name string) (fs.FileInfo, error) {
+	if fsys := f.loaded.Load(); fsys != nil {
+		return fsys.Lstat(name)
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.scanFor(name, false, false); err != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	return f.fs.Lstat(name)
+}
+
+func (f *lazyFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	if fsys := f.loaded.Load(); fsys != nil {
+		return fsys.ReadDir(name)
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.scanFor(name, true, true); err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return f.fs.ReadDir(name)
+}
+
+func (f *lazyFileSystem) ReadLink(name string) (string, error) {
+	if fsys := f.loaded.Load(); fsys != nil {
+		return fsys.ReadLink(name)
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.scanFor(name, false, false); err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return f.fs.ReadLink(name)
+}
+
+// fileSystem scans the tarball to the end and returns the complete file
+// system.
+func (f *lazyFileSystem) fileSystem() (*fileSystem, error) {
+	if fsys := f.loaded.Load(); fsys != nil {
+		return fsys, nil
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for !f.done {
+		if err := f.advance(); err != nil {
+			return nil, err
+		}
+	}
+	return f.fs, nil
+}
+
+// scanFor advances the scan until looking up name gives a result which cannot
+// be changed by the rest of the tarball. When list is true, directories are
+// only complete at the end of the tarball since entries may be added to them
+// until then.
+//
+// Errors returned by the lookup are left for the caller to report, the method
+// only returns errors which occurred while scanning the tarball.
+func (f *lazyFileSystem) scanFor(name string, follow, list bool) error {
+	for !f.done {
+		n, err := f.fs.lookup(name, follow)
+		switch {
+		case err == fs.ErrNotExist:
+			// The entry or one of its parents may appear later in the
+			// tarball.
+		case err != nil:
+			return nil
+		default:
+			switch e := n.entry.(type) {
+			case *dir:
+				// Implicit directories may be replaced by an entry appearing
+				// later in the tarball, except for the root which never is.
+				implicit := e.implicit() && (n != f.fs.root || f.fs.config.newestDirModTime)
+				if !list && !implicit {
+					return nil
+				}
+			case *link:
+				if e.target != nil {
+					return nil
+				}
+				switch err := f.scanner.builder.resolveLink(n); err {
+				case nil:
+					// The link may have been replaced by a copy of its
+					// target, which must be looked up again.
+					continue
+				case ErrDanglingLink:
+					// The target may appear later in the tarball.
+				default:
+					return nil
+				}
+			default:
+				return nil
+			}
+		}
+		if err := f.advance(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// advance scans the next header of the tarball and adds its entry to the file
+// system, completing the file system when the end of the tarball is reached.
+// Once the scan failed, the error is returned by all subsequent calls.
+func (f *lazyFileSystem) advance() error {
+	if f.err == nil {
+		f.err = f.scan()
+	}
+	return f.err
+}
+
+func (f *lazyFileSystem) scan() error {
+	s := f.scanner
+	n := len(s.entries)
+
+	switch err := s.next(); err {
+	case nil:
+	case io.EOF:
+		return f.complete()
+	default:
+		return err
+	}
+
+	for _, e := range s.entries[n:] {
+		if err := s.add(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *lazyFileSystem) complete() error {
+	s := f.scanner
+	if err := s.finish(); err != nil {
+		return err
+	}
+	if err := s.resolveLinks(); err != nil {
+		return err
+	}
+	f.fs = s.builder.fileSystem(s.data, s.size)
+	f.done = true
+	f.loaded.Store(f.fs)
+	// The scanner and its builder retain the names of all the entries, which
+	// the complete file system does not need.
+	f.scanner = nil
+	return nil
+}
+
+var (
+	_ fs.ReadDirFS      = (*lazyFileSystem)(nil)
+	_ fs.StatFS         = (*lazyFileSystem)(nil)
+	_ fslink.ReadLinkFS = (*lazyFileSystem)(nil)
+)
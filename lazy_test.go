@@ -0,0 +1,201 @@
+package tarfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stealthrocket/tarfs"
+)
+
+func TestLazy(t *testing.T) {
+	const numFiles = 1000
+	modTime := time.Unix(1e9, 0)
+
+	buffer := bytes.NewBuffer(nil)
+	writer := tar.NewWriter(buffer)
+	writeFile(t, writer, "first", "1", 0644)
+	writeLink(t, writer, "early", "files/last")
+	writeSymlink(t, writer, "symlink", "files/file-500")
+	writeFile(t, writer, "duplicate", "first wins", 0644)
+	// Incompressible blobs make the compressed tarball large enough to
+	// measure how far it was scanned.
+	prng := rand.New(rand.NewSource(0))
+	for i := 0; i < numFiles; i++ {
+		writeFile(t, writer, fmt.Sprintf("files/file-%d", i), fmt.Sprint(i), 0644)
+		if i%100 == 0 {
+			writeFile(t, writer, fmt.Sprintf("blobs/blob-%d", i), string(randomBytes(prng, 64*1024)), 0644)
+		}
+	}
+	writeFile(t, writer, "duplicate", "last wins", 0644)
+	if err := writer.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     "files",
+		Mode:     0700,
+		ModTime:  modTime,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, writer, "files/last", "last", 0644)
+	closeArchive(t, writer)
+	archive := buffer.Bytes()
+
+	for _, test := range []struct {
+		scenario string
+		data     []byte
+	}{
+		{scenario: "tar", data: archive},
+		{scenario: "tar.gz", data: compress(t, archive, gzip.BestSpeed, 1)},
+	} {
+		t.Run(test.scenario, func(t *testing.T) {
+			t.Run("scan on demand", func(t *testing.T) {
+				data := &readerAt{data: test.data}
+				fileSystem := openLazyFS(t, data)
+
+				assertReadFile(t, fileSystem, "first", "1")
+				if n := data.max.Load(); n > int64(len(test.data))/10 {
+					t.Errorf("reading the first file scanned too far: %d/%d", n, len(test.data))
+				}
+
+				assertReadFile(t, fileSystem, "symlink", "500")
+				if n := data.max.Load(); n >= int64(len(test.data))*3/4 {
+					t.Errorf("following a symbolic link scanned too far: %d/%d", n, len(test.data))
+				}
+
+				assertReadFile(t, fileSystem, "early", "last")
+				assertReadFile(t, fileSystem, "duplicate", "first wins")
+
+				_, err := fs.Stat(fileSystem, "missing")
+				if !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("error mismatch: want=%v got=%v", fs.ErrNotExist, err)
+				}
+
+				entries, err := fs.ReadDir(fileSystem, "files")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(entries) != numFiles+1 {
+					t.Errorf("wrong number of entries: want=%d got=%d", numFiles+1, len(entries))
+				}
+			})
+
+			t.Run("directories", func(t *testing.T) {
+				fileSystem := openLazyFS(t, &readerAt{data: test.data})
+
+				// The directory is implicit until its entry is found at the
+				// end of the tarball.
+				assertDirInfo(t, fileSystem, "files", 0700, modTime)
+			})
+
+			t.Run("concurrent callers", func(t *testing.T) {
+				fileSystem := openLazyFS(t, &readerAt{data: test.data})
+
+				var wg sync.WaitGroup
+				for i := 0; i < 8; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						for j := i; j < numFiles; j += 8 {
+							name := fmt.Sprintf("files/file-%d", j)
+							b, err := fs.ReadFile(fileSystem, name)
+							if err != nil {
+								t.Error(err)
+								return
+							}
+							if string(b) != fmt.Sprint(j) {
+								t.Errorf("%s: content mismatch: %q", name, b)
+								return
+							}
+						}
+					}(i)
+				}
+				wg.Wait()
+			})
+
+			t.Run("index", func(t *testing.T) {
+				fileSystem := openLazyFS(t, &readerAt{data: test.data})
+				assertReadFile(t, fileSystem, "first", "1")
+
+				index := writeIndex(t, fileSystem)
+				f, err := tarfs.OpenFSWithIndex(bytes.NewReader(test.data), int64(len(test.data)), bytes.NewReader(index))
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertReadFile(t, f, "files/last", "last")
+			})
+		})
+	}
+
+	t.Run("fstest", func(t *testing.T) {
+		fileSystem := openLazyFS(t, &readerAt{data: archive})
+		if err := fstest.TestFS(fileSystem,
+			"first",
+			"early",
+			"symlink",
+			"duplicate",
+			"files/file-0",
+			"files/last",
+		); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		buffer := bytes.NewBuffer(nil)
+		writer := tar.NewWriter(buffer)
+		writeFile(t, writer, "first", "1", 0644)
+		writeFile(t, writer, "../escape", "2", 0644)
+		writeFile(t, writer, "last", "3", 0644)
+		closeArchive(t, writer)
+
+		fileSystem := openLazyFS(t, &readerAt{data: buffer.Bytes()}, tarfs.Strict())
+		assertReadFile(t, fileSystem, "first", "1")
+
+		for i := 0; i < 2; i++ {
+			_, err := fs.ReadFile(fileSystem, "last")
+			if !errors.Is(err, tarfs.ErrUnsafePath) {
+				t.Errorf("error mismatch: want=%v got=%v", tarfs.ErrUnsafePath, err)
+			}
+		}
+		assertReadFile(t, fileSystem, "first", "1")
+	})
+}
+
+func openLazyFS(t *testing.T, data *readerAt, options ...tarfs.Option) fs.FS {
+	t.Helper()
+	options = append(options, tarfs.Lazy())
+	fileSystem, err := tarfs.OpenFS(data, int64(len(data.data)), options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fileSystem
+}
+
+// readerAt records the highest offset read from the data.
+type readerAt struct {
+	data []byte
+	max  atomic.Int64
+}
+
+func (r *readerAt) ReadAt(b []byte, offset int64) (int, error) {
+	n, err := bytes.NewReader(r.data).ReadAt(b, offset)
+	for end := offset + int64(n); ; {
+		max := r.max.Load()
+		if end <= max || r.max.CompareAndSwap(max, end) {
+			break
+		}
+	}
+	return n, err
+}
+
+var _ io.ReaderAt = (*readerAt)(nil)
@@ -0,0 +1,111 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Limits configures bounds on the resources used when opening or extracting
+// tarballs, which protect programs from crafted archives. Limits set to zero
+// are not enforced.
+type Limits struct {
+	// Maximum number of entries in the tarball.
+	MaxEntries int
+	// Maximum number of bytes in the names and link targets of all the
+	// entries of the tarball.
+	MaxPathBytes int64
+	// Maximum number of bytes in the PAX records of an entry.
+	MaxPAXBytes int64
+	// Maximum number of symbolic links followed when resolving a path,
+	// lookups exceeding the limit fail with ErrLoop. The default is 40.
+	MaxSymlinks int
+	// Maximum number of entries in a directory. Entries are counted by
+	// distinct names, including the names of parent directories implied by
+	// the paths of other entries; entries replacing one another with the same
+	// name count once.
+	MaxDirEntries int
+}
+
+// LimitError is returned when a tarball exceeds one of the configured limits.
+type LimitError struct {
+	// Name of the field of Limits which was exceeded.
+	Limit string
+	// Value of the limit.
+	Value int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("tarfs: resource limit exceeded: %s=%d", e.Limit, e.Value)
+}
+
+// limiter tracks the resources used by the entries of a tarball.
+type limiter struct {
+	limits    Limits
+	entries   int
+	pathBytes int64
+	dirs      map[string]map[string]struct{} // names in each directory
+}
+
+func (l *limiter) maxSymlinks() int {
+	if l.limits.MaxSymlinks > 0 {
+		return l.limits.MaxSymlinks
+	}
+	return maxFollowSymlink
+}
+
+// check accounts for the entry of the tarball described by h, returning a
+// *LimitError if it exceeds the limits.
+func (l *limiter) check(h *tar.Header) error {
+	l.entries++
+	if max := l.limits.MaxEntries; max > 0 && l.entries > max {
+		return &LimitError{Limit: "MaxEntries", Value: int64(max)}
+	}
+
+	l.pathBytes += int64(len(h.Name) + len(h.Linkname))
+	if max := l.limits.MaxPathBytes; max > 0 && l.pathBytes > max {
+		return &LimitError{Limit: "MaxPathBytes", Value: max}
+	}
+
+	if max := l.limits.MaxPAXBytes; max > 0 {
+		size := int64(0)
+		for key, value := range h.PAXRecords {
+			size += int64(len(key) + len(value))
+		}
+		if size > max {
+			return &LimitError{Limit: "MaxPAXBytes", Value: max}
+		}
+	}
+	return nil
+}
+
+// checkDir accounts for an entry named name in its parent directory, and for
+// the parent directories which it implies, returning a *LimitError if one of
+// the directories has too many entries. Entries with the same name are counted
+// once, as they occupy a single name in the file system.
+func (l *limiter) checkDir(name string) error {
+	max := l.limits.MaxDirEntries
+	if max <= 0 {
+		return nil
+	}
+	if l.dirs == nil {
+		l.dirs = make(map[string]map[string]struct{})
+	}
+	dir := "."
+	for _, elem := range strings.Split(name, "/") {
+		names := l.dirs[dir]
+		if names == nil {
+			names = make(map[string]struct{})
+			l.dirs[dir] = names
+		}
+		if _, ok := names[elem]; !ok {
+			if len(names) >= max {
+				return &LimitError{Limit: "MaxDirEntries", Value: int64(max)}
+			}
+			names[elem] = struct{}{}
+		}
+		dir = path.Join(dir, elem)
+	}
+	return nil
+}
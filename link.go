@@ -1,22 +1,25 @@
 package tarfs
 
 import (
-	"archive/tar"
 	"io/fs"
 )
 
 type link struct {
-	target *file
-	header *tar.Header
+	meta
+	linkname string
+	target   *file
 }
 
-func (ln *link) open(fileSystem *fileSystem) (fs.File, error) {
+func (ln *link) open(n *node) (fs.File, error) {
 	if ln.target == nil {
 		return nil, fs.ErrNotExist
 	}
-	return ln.target.openFile(fileSystem, ln.header), nil
+	return ln.target.openFile(ln.stat(n)), nil
 }
 
-func (ln *link) stat() fs.FileInfo {
-	return ln.header.FileInfo()
+func (ln *link) stat(n *node) fs.FileInfo {
+	if ln.target == nil {
+		return fileInfo{node: n, meta: &ln.meta, size: ln.size}
+	}
+	return ln.target.info(n, &ln.meta)
 }
@@ -0,0 +1,164 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// node is an entry of the file system tree.
+//
+// Nodes are named after the base name of their entry, names are interned while
+// building the file system so that names repeated across directories (e.g.
+// package.json in node_modules) share their memory. The children of a node are
+// sorted by name once the file system is built, which allows looking them up
+// with a binary search and listing them without sorting.
+type node struct {
+	name     string
+	parent   *node // nil for the root
+	entry    fileEntry
+	children []*node
+	// index maps names to children while the file system is being built and
+	// children are not sorted yet.
+	index map[string]*node
+}
+
+func (n *node) child(name string) *node {
+	if n.index != nil {
+		return n.index[name]
+	}
+	i := sort.Search(len(n.children), func(i int) bool {
+		return n.children[i].name >= name
+	})
+	if i < len(n.children) && n.children[i].name == name {
+		return n.children[i]
+	}
+	return nil
+}
+
+// sortChildren moves the children of n from the index used while building the
+// file system to the slice sorted by name.
+func (n *node) sortChildren() {
+	if n.index == nil {
+		return
+	}
+	n.children = make([]*node, 0, len(n.index))
+	for _, child := range n.index {
+		n.children = append(n.children, child)
+	}
+	sort.Slice(n.children, func(i, j int) bool {
+		return n.children[i].name < n.children[j].name
+	})
+	n.index = nil
+}
+
+// path returns the path of the node from the root of the file system.
+func (n *node) path() string {
+	if n.parent == nil {
+		return "."
+	}
+	var elems []string
+	for ; n.parent != nil; n = n.parent {
+		elems = append(elems, n.name)
+	}
+	for i, j := 0, len(elems)-1; i < j; i, j = i+1, j-1 {
+		elems[i], elems[j] = elems[j], elems[i]
+	}
+	return strings.Join(elems, "/")
+}
+
+// forEach calls f for n and all its descendants, parents before their children.
+// The nodes are visited in lexical order once the file system is built.
+func (n *node) forEach(f func(*node)) {
+	f(n)
+	for _, child := range n.children {
+		child.forEach(f)
+	}
+}
+
+// meta is the packed metadata of an entry, which carries what is needed to
+// implement fs.FileInfo. The complete tar header of the entry is decoded from
+// the tarball when requested, so the file system does not need to retain the
+// headers of all its entries in memory.
+type meta struct {
+	data   io.ReaderAt // uncompressed tarball, nil for implicit directories
+	offset int64       // offset of the first block of the entry headers
+	size   int64
+	sec    int64
+	nsec   int32
+	mode   fs.FileMode
+}
+
+func makeMeta(data io.ReaderAt, offset int64, h *tar.Header, mode fs.FileMode) meta {
+	m := meta{data: data, offset: offset, size: h.Size, mode: mode}
+	m.setModTime(h.ModTime)
+	return m
+}
+
+func (m *meta) modTime() time.Time { return time.Unix(m.sec, int64(m.nsec)) }
+
+func (m *meta) setModTime(t time.Time) { m.sec, m.nsec = t.Unix(), int32(t.Nanosecond()) }
+
+// header decodes the tar header of the entry, setting its name to the path of
+// the entry in the file system, which differs from the name in the tarball for
+// hard links replaced by a copy of their target. The method returns nil if the
+// header cannot be read.
+func (m *meta) header(name string) *tar.Header {
+	if m.data == nil {
+		return nil
+	}
+	r := tar.NewReader(io.NewSectionReader(m.data, m.offset, math.MaxInt64-m.offset))
+	h, _, err := nextHeader(r)
+	if err != nil {
+		return nil
+	}
+	h.Name = name
+	return h
+}
+
+// fileInfo implements fs.FileInfo for all the entries of the file system.
+//
+// The inode number and link count of regular files are exposed by the Ino and
+// Nlink methods, and used to detect hard links when archiving the file system.
+// Sys returns the tar header of the entry.
+type fileInfo struct {
+	node  *node
+	meta  *meta
+	size  int64
+	ino   uint64
+	nlink uint64
+}
+
+func (info fileInfo) Name() string       { return info.node.name }
+func (info fileInfo) Size() int64        { return info.size }
+func (info fileInfo) Mode() fs.FileMode  { return info.meta.mode }
+func (info fileInfo) ModTime() time.Time { return info.meta.modTime() }
+func (info fileInfo) IsDir() bool        { return info.meta.mode.IsDir() }
+func (info fileInfo) Ino() uint64        { return info.ino }
+
+// Nlink returns 1 for entries other than regular files, which cannot have hard
+// links in a tarball.
+func (info fileInfo) Nlink() uint64 {
+	if info.nlink == 0 {
+		return 1
+	}
+	return info.nlink
+}
+
+func (info fileInfo) Sys() any {
+	if info.meta.data != nil {
+		return info.meta.header(info.node.path())
+	}
+	// Implicit directories do not have an entry in the tarball, synthesize a
+	// header so the type of Sys is the same for all entries.
+	return &tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     info.node.path(),
+		Mode:     int64(info.meta.mode.Perm()),
+		ModTime:  info.ModTime(),
+	}
+}
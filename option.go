@@ -0,0 +1,296 @@
+package tarfs
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Option represents options that can be passed when opening or extracting
+// tarballs.
+type Option func(*config)
+
+type config struct {
+	implicitDirMode        fs.FileMode
+	implicitDirModTime     time.Time
+	newestDirModTime       bool
+	refuseEscapingSymlinks bool
+	duplicates             DuplicatePolicy
+	strict                 bool
+	limits                 Limits
+	lazy                   bool
+	cacheBlockSize         int
+	cacheCapacity          int64
+	reproducible           bool
+	reproducibleModTime    time.Time
+	excludePatterns        []string
+	filters                []func(string, fs.DirEntry) bool
+	nameMaps               []func(string) string
+}
+
+func newConfig(options []Option) *config {
+	c := &config{
+		implicitDirMode:    0755,
+		implicitDirModTime: time.Unix(0, 0),
+	}
+	for _, opt := range options {
+		opt(c)
+	}
+	return c
+}
+
+// ImplicitDirMode sets the permissions of directories which do not have an
+// entry in the tarball, but exist because they contain other entries. The
+// default is 0755.
+func ImplicitDirMode(mode fs.FileMode) Option {
+	return func(c *config) { c.implicitDirMode = mode.Perm() }
+}
+
+// ImplicitDirModTime sets the modification time of directories which do not
+// have an entry in the tarball. The default is the Unix epoch.
+func ImplicitDirModTime(modTime time.Time) Option {
+	return func(c *config) { c.implicitDirModTime, c.newestDirModTime = modTime, false }
+}
+
+// ImplicitDirNewestModTime configures directories which do not have an entry
+// in the tarball to report the most recent modification time of the entries
+// that they contain.
+func ImplicitDirNewestModTime() Option {
+	return func(c *config) { c.newestDirModTime = true }
+}
+
+// RefuseEscapingSymlinks configures the file system to return ErrEscape when
+// following symbolic links whose targets refer to locations above the root of
+// the file system (e.g. "../../etc/hosts" or "/../etc"). By default, ".."
+// components never go above the root, as if the root of the file system was
+// the root of a chroot. Absolute targets are resolved from the root of the file
+// system in both cases.
+func RefuseEscapingSymlinks() Option {
+	return func(c *config) { c.refuseEscapingSymlinks = true }
+}
+
+// DuplicatePolicy defines how entries with the same name are handled when they
+// appear multiple times in a tarball.
+type DuplicatePolicy int
+
+const (
+	// LastWins replaces entries with the ones appearing later in the tarball,
+	// removing the children of replaced directories unless they are replaced
+	// by another directory. This is the default policy.
+	LastWins DuplicatePolicy = iota
+	// FirstWins ignores entries with the same name as an entry appearing
+	// earlier in the tarball.
+	FirstWins
+	// RejectDuplicates causes opening the tarball to fail with a
+	// *DuplicateError when it contains multiple entries with the same name.
+	RejectDuplicates
+)
+
+// Duplicates sets the policy applied to entries with the same name. The policy
+// applies to entries of a single tarball, layers of file systems opened by
+// OpenLayersFS always replace the entries of the layers below them.
+func Duplicates(policy DuplicatePolicy) Option {
+	return func(c *config) { c.duplicates = policy }
+}
+
+// DuplicateError is returned when opening a tarball containing multiple entries
+// with the same name, if the RejectDuplicates policy is used.
+type DuplicateError struct {
+	Name string
+	// Offsets of the first headers of the two entries in the uncompressed
+	// tarball, which include the extended headers preceding them.
+	FirstOffset int64
+	Offset      int64
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("tarfs: duplicate entry %q at offsets %d and %d", e.Name, e.FirstOffset, e.Offset)
+}
+
+// ResourceLimits sets limits on the resources used when opening or extracting
+// tarballs. Opening a file system or extracting a tarball fails with a
+// *LimitError when a limit is exceeded.
+func ResourceLimits(limits Limits) Option {
+	return func(c *config) { c.limits = limits }
+}
+
+// Strict enables the validation of tarballs, causing opening file systems to
+// fail with an *EntryError when the tarball contains entries with absolute
+// names or names referencing parent directories, entries of unsupported types,
+// entries whose parent is not a directory, or hard links to entries which do
+// not exist, are directories, or form a cycle.
+//
+// Strict mode also sets the RejectDuplicates policy, which can be changed by
+// passing the Duplicates option after Strict.
+func Strict() Option {
+	return func(c *config) { c.strict, c.duplicates = true, RejectDuplicates }
+}
+
+// EntryError is returned when opening a tarball in strict mode fails because
+// of an invalid entry.
+type EntryError struct {
+	// Name of the entry in the tarball.
+	Name string
+	// Offset of the first header of the entry in the uncompressed tarball,
+	// which includes the extended headers preceding it.
+	Offset int64
+	// Err is the reason why the entry is invalid (e.g. ErrUnsafePath).
+	Err error
+}
+
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("%s: %q at offset %d", e.Err, e.Name, e.Offset)
+}
+
+func (e *EntryError) Unwrap() error { return e.Err }
+
+// Lazy configures OpenFS to return without scanning the tarball. Entries are
+// read on demand, the scan only advances as far as needed to serve each call
+// to Open, Stat, ReadDir or ReadLink, and is shared by concurrent callers.
+// Listing directories, including opening them, and looking up names that do
+// not exist scan the tarball to the end.
+//
+// Entries are returned as soon as they are found, which is incompatible with
+// the LastWins policy: lazy file systems use the FirstWins policy instead,
+// unless RejectDuplicates is set. Errors caused by invalid entries, including
+// exceeded limits, are returned by the calls which advanced the scan to them,
+// and by all subsequent calls which need to advance the scan. Inode numbers
+// and link counts of regular files are only reported once the scan completed.
+//
+// The option only applies to OpenFS.
+func Lazy() Option {
+	return func(c *config) { c.lazy = true }
+}
+
+// Reproducible configures Archive to write the same bytes when archiving file
+// systems with the same content, regardless of when and by whom the files were
+// created: modification times more recent than modTime, or not set, are
+// replaced by modTime and truncated to the second, access and change times are
+// omitted, the owner of all entries is set to root (uid and gid 0, without user
+// and group names), extended attributes are omitted, and only devices have
+// device numbers. Other metadata, such as permissions, is preserved.
+//
+// SourceDateEpoch can be used to obtain modTime from the environment, following
+// the convention of reproducible builds.
+func Reproducible(modTime time.Time) Option {
+	return func(c *config) { c.reproducible, c.reproducibleModTime = true, modTime }
+}
+
+// SourceDateEpoch returns the time set in the SOURCE_DATE_EPOCH environment
+// variable, as a number of seconds since the Unix epoch, or the Unix epoch if
+// the variable is not set or is invalid.
+//
+// See https://reproducible-builds.org/specs/source-date-epoch/
+func SourceDateEpoch() time.Time {
+	if v, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		return time.Unix(v, 0)
+	}
+	return time.Unix(0, 0)
+}
+
+// Exclude configures Archive to skip the entries matching patterns, which use
+// the syntax of .gitignore files:
+//
+//   - Blank patterns and patterns starting with # are ignored.
+//   - Patterns are matched against the path of entries with path.Match, where
+//     "**" matches any number of directories (e.g. "**/testdata"). A trailing
+//     "**" matches everything inside a directory, but not the directory itself
+//     (e.g. "logs/**" matches "logs/app.log" but not "logs").
+//   - Patterns containing a slash, other than a trailing one, are anchored to
+//     the root of the file system (e.g. "/build" or "docs/*.md"), the other
+//     patterns match entries at any depth (e.g. ".git" or "*.o").
+//   - Patterns ending with a slash only match directories.
+//   - Patterns starting with ! include the entries excluded by the patterns
+//     preceding them. The last pattern matching an entry takes precedence.
+//
+// Excluding a directory excludes all the entries that it contains, which are
+// not read, and cannot be included back by negated patterns.
+//
+// Patterns match the paths of the entries in the file system, before their
+// names are mapped by options like MapNames. Archive returns an error wrapping
+// path.ErrBadPattern when a pattern is malformed. Patterns accumulate when the
+// option is passed multiple times.
+func Exclude(patterns ...string) Option {
+	return func(c *config) { c.excludePatterns = append(c.excludePatterns, patterns...) }
+}
+
+// Filter configures Archive to call include for the entries which are not
+// excluded by patterns, skipping those for which it returns false. Like with
+// Exclude, directories which are skipped are not read. When the option is
+// passed multiple times, entries are archived only if all the filters include
+// them.
+func Filter(include func(path string, entry fs.DirEntry) bool) Option {
+	return func(c *config) { c.filters = append(c.filters, include) }
+}
+
+// MapNames configures Archive to call mapName with the names of the entries,
+// and to write them to the tarball under the returned names, which are cleaned
+// with path.Clean. Entries for which mapName returns an empty string are
+// skipped, but the entries that they contain are still archived.
+//
+// The names of hard link targets are mapped consistently with the entries that
+// they link to. The targets of symbolic links are written unchanged. When the
+// parent directory of an entry is not written under the name of its parent in
+// the tarball (e.g. when entries are placed under a prefix), directory entries
+// are added for the missing parents. Archive fails with an error wrapping
+// ErrUnsafePath if a name is absolute or references parent directories after
+// being mapped.
+//
+// When the option is passed multiple times, or combined with NamePrefix,
+// StripComponents and Rename, names are mapped in the order of the options.
+func MapNames(mapName func(name string) string) Option {
+	return func(c *config) { c.nameMaps = append(c.nameMaps, mapName) }
+}
+
+// NamePrefix configures Archive to place the entries under the directory
+// prefix (e.g. "app"), the root of the file system being archived as prefix
+// itself. See MapNames for details.
+func NamePrefix(prefix string) Option {
+	return MapNames(func(name string) string {
+		if name == "." {
+			return prefix
+		}
+		return path.Join(prefix, name)
+	})
+}
+
+// StripComponents configures Archive to remove the first n elements of the
+// names of the entries, skipping the entries which have n elements or less,
+// like the --strip-components option of GNU tar. See MapNames for details.
+func StripComponents(n int) Option {
+	return MapNames(func(name string) string {
+		switch {
+		case n <= 0:
+			return name
+		case name == ".":
+			return ""
+		}
+		elems := strings.SplitN(name, "/", n+1)
+		if len(elems) <= n {
+			return ""
+		}
+		return elems[n]
+	})
+}
+
+// Rename configures Archive to write the entry named old, and the entries that
+// it contains if it is a directory, under the name new. See MapNames for
+// details.
+func Rename(old, new string) Option {
+	return MapNames(func(name string) string {
+		switch {
+		case name == old:
+			return new
+		case old == ".":
+			return path.Join(new, name)
+		case strings.HasPrefix(name, old) && name[len(old)] == '/':
+			return path.Join(new, name[len(old)+1:])
+		default:
+			return name
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package tarfs
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// pattern is a compiled exclusion pattern, see Exclude for the syntax.
+type pattern struct {
+	elems   []string // "**" matches any number of path elements
+	negate  bool
+	dirOnly bool
+}
+
+// compilePatterns parses exclusion patterns, skipping blank lines and comments.
+func compilePatterns(patterns []string) ([]pattern, error) {
+	compiled := make([]pattern, 0, len(patterns))
+	for _, s := range patterns {
+		s = strings.TrimRight(s, " \t\r")
+		if s == "" || s[0] == '#' {
+			continue
+		}
+		p, err := compilePattern(s)
+		if err != nil {
+			return nil, fmt.Errorf("tarfs: %q: %w", s, err)
+		}
+		compiled = append(compiled, p)
+	}
+	return compiled, nil
+}
+
+func compilePattern(s string) (pattern, error) {
+	var p pattern
+	if s[0] == '!' {
+		p.negate, s = true, s[1:]
+	}
+	if strings.HasSuffix(s, "/") {
+		p.dirOnly, s = true, strings.TrimRight(s, "/")
+	}
+	// Patterns containing a separator are relative to the root of the file
+	// system, the others match at any depth.
+	anchored := strings.Contains(s, "/")
+	s = strings.TrimLeft(s, "/")
+	if s == "" {
+		return p, path.ErrBadPattern
+	}
+	if !anchored {
+		p.elems = append(p.elems, "**")
+	}
+	for _, elem := range strings.Split(s, "/") {
+		if elem == "" {
+			continue
+		}
+		if elem != "**" {
+			// Matching against an empty name reports malformed patterns.
+			if _, err := path.Match(elem, ""); err != nil {
+				return p, err
+			}
+		}
+		p.elems = append(p.elems, elem)
+	}
+	return p, nil
+}
+
+func (p *pattern) match(elems []string, isDir bool) bool {
+	return (isDir || !p.dirOnly) && matchElems(p.elems, elems)
+}
+
+func matchElems(pattern, elems []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			if len(pattern) == 1 {
+				// A trailing "**" matches the content of a directory.
+				return len(elems) > 0
+			}
+			for i := len(elems); i >= 0; i-- {
+				if matchElems(pattern[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+			return false
+		}
+		pattern, elems = pattern[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
+
+// archiveFilter selects the entries of file systems written by Archive.
+type archiveFilter struct {
+	patterns []pattern
+	filters  []func(string, fs.DirEntry) bool
+}
+
+func newArchiveFilter(config *config) (*archiveFilter, error) {
+	patterns, err := compilePatterns(config.excludePatterns)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveFilter{patterns: patterns, filters: config.filters}, nil
+}
+
+// include returns true if the entry at name must be archived. The root of the
+// file system is always included.
+func (f *archiveFilter) include(name string, entry fs.DirEntry) bool {
+	if name == "." {
+		return true
+	}
+	if len(f.patterns) > 0 {
+		elems := strings.Split(name, "/")
+		excluded := false
+		for i := range f.patterns {
+			if p := &f.patterns[i]; p.negate == excluded && p.match(elems, entry.IsDir()) {
+				excluded = !p.negate
+			}
+		}
+		if excluded {
+			return false
+		}
+	}
+	for _, filter := range f.filters {
+		if !filter(name, entry) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,21 @@
+//go:build go1.25
+
+package tarfs
+
+import (
+	"io/fs"
+
+	"github.com/stealthrocket/fslink"
+)
+
+func readLink(fsys fs.FS, name string) (string, error) {
+	if f, ok := fsys.(fs.ReadLinkFS); ok {
+		return f.ReadLink(name)
+	}
+	return fslink.ReadLink(fsys, name)
+}
+
+var (
+	_ fs.ReadLinkFS = (*fileSystem)(nil)
+	_ fs.ReadLinkFS = (*lazyFileSystem)(nil)
+)
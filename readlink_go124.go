@@ -0,0 +1,13 @@
+//go:build !go1.25
+
+package tarfs
+
+import (
+	"io/fs"
+
+	"github.com/stealthrocket/fslink"
+)
+
+func readLink(fsys fs.FS, name string) (string, error) {
+	return fslink.ReadLink(fsys, name)
+}
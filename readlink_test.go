@@ -0,0 +1,94 @@
+//go:build go1.25
+
+package tarfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stealthrocket/tarfs"
+)
+
+func TestReadLinkFS(t *testing.T) {
+	t.Run("lstat", func(t *testing.T) {
+		buffer := bytes.NewBuffer(nil)
+		writer := tar.NewWriter(buffer)
+
+		writeFile(t, writer, "etc/hosts", "127.0.0.1 localhost", 0644)
+		writeSymlink(t, writer, "etc/hosts.link", "hosts")
+		writeSymlink(t, writer, "usr/lib/absolute", "/etc/hosts")
+		writeSymlink(t, writer, "usr/etc", "../etc")
+		closeArchive(t, writer)
+
+		fileSystem := openFS(t, buffer.Bytes())
+		if err := fstest.TestFS(fileSystem, "etc/hosts", "etc/hosts.link", "usr/lib/absolute"); err != nil {
+			t.Fatal(err)
+		}
+
+		for name, link := range map[string]string{
+			"etc/hosts.link":   "hosts",
+			"usr/lib/absolute": "/etc/hosts",
+			"usr/etc":          "../etc",
+		} {
+			info, err := fs.Lstat(fileSystem, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Type() != fs.ModeSymlink {
+				t.Errorf("%s: file type mismatch: want=%v got=%v", name, fs.ModeSymlink, info.Mode().Type())
+			}
+			got, err := fs.ReadLink(fileSystem, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != link {
+				t.Errorf("%s: symbolic link mismatch: want=%q got=%q", name, link, got)
+			}
+		}
+
+		info, err := fs.Lstat(fileSystem, "usr/etc/hosts")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.Mode().IsRegular() {
+			t.Errorf("usr/etc/hosts: expected a regular file: %v", info.Mode())
+		}
+	})
+
+	t.Run("archive", func(t *testing.T) {
+		tmp := t.TempDir()
+		if err := os.WriteFile(filepath.Join(tmp, "file"), []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("file", filepath.Join(tmp, "relative")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("/file", filepath.Join(tmp, "absolute")); err != nil {
+			t.Fatal(err)
+		}
+
+		buffer := bytes.NewBuffer(nil)
+		writer := tar.NewWriter(buffer)
+		if err := tarfs.Archive(writer, os.DirFS(tmp)); err != nil {
+			t.Fatal(err)
+		}
+		closeArchive(t, writer)
+
+		fileSystem := openFS(t, buffer.Bytes())
+		assertReadLink(t, fileSystem, "relative", "file")
+		assertReadFile(t, fileSystem, "absolute", "hello")
+
+		link, err := fs.ReadLink(fileSystem, "absolute")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if link != "/file" {
+			t.Errorf("symbolic link mismatch: want=%q got=%q", "/file", link)
+		}
+	})
+}
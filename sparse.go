@@ -0,0 +1,300 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	paxGNUSparseMajor = "GNU.sparse.major"
+	paxGNUSparseMinor = "GNU.sparse.minor"
+	paxGNUSparseMap   = "GNU.sparse.map"
+
+	// Sparse maps are limited to the same size as other special files by the
+	// archive/tar package.
+	maxSparseBlocks = (1 << 20) / headerSize
+)
+
+// sparseEntry is a fragment of data of a sparse file. The fragments are stored
+// contiguously in the tarball, areas of the file between fragments are holes
+// which read as zeros.
+type sparseEntry struct {
+	offset int64 // logical offset in the file
+	length int64
+	phys   int64 // offset of the data relative to the start of the entry data
+}
+
+// sparseMap returns the data fragments of the entry described by h, which is
+// located at offset in data. The archive/tar package does not expose the
+// sparse maps, so they are parsed from the PAX records of the header for the
+// GNU PAX formats 0.0 and 0.1, and from the blocks preceding the data for the
+// old GNU format and the GNU PAX format 1.0. The function returns nil if the
+// entry is not a sparse file.
+func sparseMap(data io.ReaderAt, offset int64, h *tar.Header) ([]sparseEntry, error) {
+	var fragments []int64
+
+	major, minor := h.PAXRecords[paxGNUSparseMajor], h.PAXRecords[paxGNUSparseMinor]
+	switch {
+	case h.Typeflag == tar.TypeGNUSparse:
+		blocks, err := readSparseBlocks(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		fragments, err = parseOldGNUSparseMap(blocks)
+		if err != nil {
+			return nil, err
+		}
+
+	case major == "1" && minor == "0":
+		blocks, err := readSparseBlocks(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		fragments, err = parseSparseMap1x0(blocks[headerSize:])
+		if err != nil {
+			return nil, err
+		}
+
+	case h.PAXRecords[paxGNUSparseMap] != "":
+		for _, s := range strings.Split(h.PAXRecords[paxGNUSparseMap], ",") {
+			v, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return nil, tar.ErrHeader
+			}
+			fragments = append(fragments, v)
+		}
+
+	default:
+		return nil, nil
+	}
+
+	return makeSparseMap(fragments, h.Size)
+}
+
+// makeSparseMap validates the list of (offset, length) pairs of a sparse map,
+// which must be sorted, non-overlapping, and within the size of the file.
+func makeSparseMap(fragments []int64, size int64) ([]sparseEntry, error) {
+	if len(fragments)%2 != 0 {
+		return nil, tar.ErrHeader
+	}
+	sparse := make([]sparseEntry, 0, len(fragments)/2)
+	end, phys := int64(0), int64(0)
+	for i := 0; i < len(fragments); i += 2 {
+		offset, length := fragments[i], fragments[i+1]
+		if offset < end || length < 0 || offset+length < offset || offset+length > size {
+			return nil, tar.ErrHeader
+		}
+		sparse = append(sparse, sparseEntry{offset: offset, length: length, phys: phys})
+		end, phys = offset+length, phys+length
+	}
+	return sparse, nil
+}
+
+// readSparseBlocks returns the blocks of the tarball between the header of the
+// entry whose data starts at offset and the data, which is where the old GNU
+// format and the GNU PAX format 1.0 store the sparse maps. The header is found
+// by searching backward for a block with a valid checksum.
+func readSparseBlocks(data io.ReaderAt, offset int64) ([]byte, error) {
+	var block [headerSize]byte
+	for n := 1; n <= maxSparseBlocks && offset >= int64(n)*headerSize; n++ {
+		start := offset - int64(n)*headerSize
+		if _, err := data.ReadAt(block[:], start); err != nil {
+			return nil, err
+		}
+		if validHeader(block[:]) {
+			blocks := make([]byte, n*headerSize)
+			if _, err := data.ReadAt(blocks, start); err != nil {
+				return nil, err
+			}
+			return blocks, nil
+		}
+	}
+	return nil, tar.ErrHeader
+}
+
+func validHeader(block []byte) bool {
+	chksum, err := parseNumeric(block[148:156])
+	if err != nil {
+		return false
+	}
+	unsigned, signed := int64(0), int64(0)
+	for i, c := range block {
+		if i >= 148 && i < 156 {
+			c = ' '
+		}
+		unsigned += int64(c)
+		signed += int64(int8(c))
+	}
+	return chksum == unsigned || chksum == signed
+}
+
+// parseOldGNUSparseMap parses the sparse map of the old GNU format, stored in
+// the header of the entry and in the extension blocks that follow it.
+func parseOldGNUSparseMap(blocks []byte) ([]int64, error) {
+	const (
+		entrySize       = 24
+		headerEntries   = 386
+		headerExtended  = 482
+		extendedEntries = 21
+		extendedFlag    = 504
+	)
+
+	var fragments []int64
+	entries, count, extended := blocks[headerEntries:headerExtended], 4, blocks[headerExtended]
+
+	for {
+		for i := 0; i < count; i++ {
+			entry := entries[i*entrySize : (i+1)*entrySize]
+			if entry[0] == 0 {
+				break
+			}
+			offset, err := parseNumeric(entry[:12])
+			if err != nil {
+				return nil, err
+			}
+			length, err := parseNumeric(entry[12:])
+			if err != nil {
+				return nil, err
+			}
+			fragments = append(fragments, offset, length)
+		}
+
+		blocks = blocks[headerSize:]
+		if extended == 0 {
+			break
+		}
+		if len(blocks) < headerSize {
+			return nil, tar.ErrHeader
+		}
+		entries, count, extended = blocks[:extendedFlag], extendedEntries, blocks[extendedFlag]
+	}
+
+	if len(blocks) != 0 {
+		return nil, tar.ErrHeader
+	}
+	return fragments, nil
+}
+
+// parseSparseMap1x0 parses the sparse map of the GNU PAX format 1.0, made of
+// newline terminated decimal numbers: the number of fragments, followed by the
+// offset and length of each fragment.
+func parseSparseMap1x0(b []byte) ([]int64, error) {
+	next := func() (int64, error) {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			return 0, tar.ErrHeader
+		}
+		v, err := strconv.ParseInt(string(b[:i]), 10, 64)
+		if err != nil {
+			return 0, tar.ErrHeader
+		}
+		b = b[i+1:]
+		return v, nil
+	}
+
+	n, err := next()
+	if err != nil || n < 0 || n > int64(len(b)) {
+		return nil, tar.ErrHeader
+	}
+	fragments := make([]int64, 2*n)
+	for i := range fragments {
+		if fragments[i], err = next(); err != nil {
+			return nil, err
+		}
+	}
+	return fragments, nil
+}
+
+// parseNumeric parses a numeric field of a tar header, encoded either in octal
+// or in base-256.
+func parseNumeric(b []byte) (int64, error) {
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		if len(b) > 9 {
+			for _, c := range b[1 : len(b)-8] {
+				if c != 0 {
+					return 0, tar.ErrHeader
+				}
+			}
+			b = b[len(b)-8:]
+		}
+		v := uint64(0)
+		for i, c := range b {
+			if i == 0 {
+				c &= 0x7f
+			}
+			v = v<<8 | uint64(c)
+		}
+		if v > 1<<63-1 {
+			return 0, tar.ErrHeader
+		}
+		return int64(v), nil
+	}
+
+	s := strings.Trim(string(b), " \x00")
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseInt(s, 8, 64)
+	if err != nil {
+		return 0, tar.ErrHeader
+	}
+	return v, nil
+}
+
+// sparseReader reads the logical content of a sparse file, mapping offsets to
+// the data fragments and filling holes with zeros.
+type sparseReader struct {
+	data   io.ReaderAt
+	offset int64 // offset of the entry data in the tarball
+	size   int64 // logical size of the file
+	sparse []sparseEntry
+}
+
+func (r *sparseReader) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	n := len(b)
+	if remain := r.size - off; int64(n) > remain {
+		n = int(remain)
+	}
+	buf := b[:n]
+	for i := range buf {
+		buf[i] = 0
+	}
+
+	end := off + int64(n)
+	i := sort.Search(len(r.sparse), func(i int) bool {
+		return r.sparse[i].offset+r.sparse[i].length > off
+	})
+	for ; i < len(r.sparse) && r.sparse[i].offset < end; i++ {
+		s := r.sparse[i]
+		from, to := s.offset, s.offset+s.length
+		if from < off {
+			from = off
+		}
+		if to > end {
+			to = end
+		}
+		phys := r.offset + s.phys + (from - s.offset)
+		if _, err := r.data.ReadAt(buf[from-off:to-off], phys); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,261 @@
+package tarfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stealthrocket/tarfs"
+)
+
+type fragment struct {
+	offset int64
+	data   string
+}
+
+func TestSparse(t *testing.T) {
+	const size = 100000
+	fragments := []fragment{
+		{0, "hello"},
+		{1000, "sparse"},
+		{4095, "across block boundaries"},
+		{50000, strings.Repeat("0123456789", 100)},
+		{70000, "a"},
+		{99990, "0123456789"},
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	writer := tar.NewWriter(buffer)
+	writeFile(t, writer, "regular", "not sparse", 0644)
+	writeSparse0x1(t, writer, buffer, "pax-0.1", size, fragments)
+	writeSparse1x0(t, writer, buffer, "pax-1.0", size, fragments)
+	writeOldGNUSparse(t, writer, buffer, "old-gnu", size, fragments)
+	writeOldGNUSparse(t, writer, buffer, "holes", 4096, nil)
+	writeFile(t, writer, "trailer", "not sparse either", 0644)
+	closeArchive(t, writer)
+
+	want := make([]byte, size)
+	for _, f := range fragments {
+		copy(want[f.offset:], f.data)
+	}
+
+	for _, test := range []struct {
+		scenario string
+		open     func(t *testing.T) fs.FS
+	}{
+		{
+			scenario: "tar",
+			open:     func(t *testing.T) fs.FS { return openFS(t, buffer.Bytes()) },
+		},
+		{
+			scenario: "tar.gz",
+			open: func(t *testing.T) fs.FS {
+				return openFS(t, compress(t, buffer.Bytes(), gzip.BestSpeed, 1))
+			},
+		},
+		{
+			scenario: "index",
+			open: func(t *testing.T) fs.FS {
+				archive := buffer.Bytes()
+				index := writeIndex(t, openFS(t, archive))
+				f, err := tarfs.OpenFSWithIndex(bytes.NewReader(archive), int64(len(archive)), bytes.NewReader(index))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return f
+			},
+		},
+	} {
+		t.Run(test.scenario, func(t *testing.T) {
+			fileSystem := test.open(t)
+			assertReadFile(t, fileSystem, "regular", "not sparse")
+			assertReadFile(t, fileSystem, "trailer", "not sparse either")
+			assertReadFile(t, fileSystem, "holes", string(make([]byte, 4096)))
+
+			for _, name := range []string{"pax-0.1", "pax-1.0", "old-gnu"} {
+				assertReadFile(t, fileSystem, name, string(want))
+				assertSparseReadAt(t, fileSystem, name, want)
+			}
+		})
+	}
+}
+
+func assertSparseReadAt(t *testing.T, fileSystem fs.FS, name string, want []byte) {
+	t.Helper()
+	f, err := fileSystem.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(want)) {
+		t.Errorf("%s: size mismatch: want=%d got=%d", name, len(want), info.Size())
+	}
+
+	r := f.(io.ReaderAt)
+	prng := rand.New(rand.NewSource(0))
+	for i := 0; i < 100; i++ {
+		offset := prng.Int63n(int64(len(want)))
+		length := prng.Intn(10000)
+		got := make([]byte, length)
+		n, err := r.ReadAt(got, offset)
+		end := offset + int64(length)
+		if end > int64(len(want)) {
+			end = int64(len(want))
+			if err != io.EOF {
+				t.Fatalf("%s: reading past the end: %v", name, err)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got[:n], want[offset:end]) {
+			t.Fatalf("%s: content mismatch at offset %d (length=%d)", name, offset, length)
+		}
+	}
+}
+
+func sparseData(fragments []fragment) string {
+	var data strings.Builder
+	for _, f := range fragments {
+		data.WriteString(f.data)
+	}
+	return data.String()
+}
+
+// The sparse entries are written directly to the buffer that the tar.Writer
+// writes to, since tar.Writer supports neither the old GNU sparse format nor
+// the PAX records of the GNU sparse formats.
+
+func writeSparse0x1(t *testing.T, w *tar.Writer, b *bytes.Buffer, name string, size int64, fragments []fragment) {
+	t.Helper()
+	var sparseMap []string
+	for _, f := range fragments {
+		sparseMap = append(sparseMap, strconv.FormatInt(f.offset, 10), strconv.Itoa(len(f.data)))
+	}
+	data := sparseData(fragments)
+	writePAXRecords(t, w, b, [][2]string{
+		{"GNU.sparse.major", "0"},
+		{"GNU.sparse.minor", "1"},
+		{"GNU.sparse.size", strconv.FormatInt(size, 10)},
+		{"GNU.sparse.numblocks", strconv.Itoa(len(fragments))},
+		{"GNU.sparse.map", strings.Join(sparseMap, ",")},
+	})
+	writeRawEntry(b, rawHeader(name, tar.TypeReg, int64(len(data)), "ustar\x0000"), data)
+}
+
+func writeSparse1x0(t *testing.T, w *tar.Writer, b *bytes.Buffer, name string, size int64, fragments []fragment) {
+	t.Helper()
+	sparseMap := fmt.Sprintf("%d\n", len(fragments))
+	for _, f := range fragments {
+		sparseMap += fmt.Sprintf("%d\n%d\n", f.offset, len(f.data))
+	}
+	sparseMap += strings.Repeat("\x00", (512-len(sparseMap)%512)%512)
+	data := sparseMap + sparseData(fragments)
+	writePAXRecords(t, w, b, [][2]string{
+		{"GNU.sparse.major", "1"},
+		{"GNU.sparse.minor", "0"},
+		{"GNU.sparse.name", name},
+		{"GNU.sparse.realsize", strconv.FormatInt(size, 10)},
+	})
+	writeRawEntry(b, rawHeader("GNUSparseFile.0/"+name, tar.TypeReg, int64(len(data)), "ustar\x0000"), data)
+}
+
+func writeOldGNUSparse(t *testing.T, w *tar.Writer, b *bytes.Buffer, name string, size int64, fragments []fragment) {
+	t.Helper()
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	data := sparseData(fragments)
+	header := rawHeader(name, tar.TypeGNUSparse, int64(len(data)), "ustar  \x00")
+	writeOctal(header[483:495], size)
+
+	var extensions [][512]byte
+	entries := header[386:482]
+	for _, f := range fragments {
+		if len(entries) == 0 {
+			extensions = append(extensions, [512]byte{})
+			if len(extensions) == 1 {
+				header[482] = 1
+			} else {
+				extensions[len(extensions)-2][504] = 1
+			}
+			entries = extensions[len(extensions)-1][:504]
+		}
+		writeOctal(entries[0:12], f.offset)
+		writeOctal(entries[12:24], int64(len(f.data)))
+		entries = entries[24:]
+	}
+	setChecksum(header)
+
+	b.Write(header)
+	for _, ext := range extensions {
+		b.Write(ext[:])
+	}
+	writeData(b, data)
+}
+
+func writePAXRecords(t *testing.T, w *tar.Writer, b *bytes.Buffer, records [][2]string) {
+	t.Helper()
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var data string
+	for _, r := range records {
+		record := " " + r[0] + "=" + r[1] + "\n"
+		n := len(record)
+		for n < len(strconv.Itoa(n))+len(record) {
+			n++
+		}
+		data += strconv.Itoa(n) + record
+	}
+	writeRawEntry(b, rawHeader("PaxHeaders.0", tar.TypeXHeader, int64(len(data)), "ustar\x0000"), data)
+}
+
+func rawHeader(name string, typeflag byte, size int64, magic string) []byte {
+	header := make([]byte, 512)
+	copy(header[0:100], name)
+	writeOctal(header[100:108], 0644)
+	writeOctal(header[108:116], 0)
+	writeOctal(header[116:124], 0)
+	writeOctal(header[124:136], size)
+	writeOctal(header[136:148], 0)
+	header[156] = typeflag
+	copy(header[257:265], magic)
+	return header
+}
+
+func writeRawEntry(b *bytes.Buffer, header []byte, data string) {
+	setChecksum(header)
+	b.Write(header)
+	writeData(b, data)
+}
+
+func writeData(b *bytes.Buffer, data string) {
+	b.WriteString(data)
+	b.WriteString(strings.Repeat("\x00", (512-len(data)%512)%512))
+}
+
+func writeOctal(field []byte, v int64) {
+	s := strconv.FormatInt(v, 8)
+	copy(field, strings.Repeat("0", len(field)-1-len(s))+s)
+}
+
+func setChecksum(header []byte) {
+	copy(header[148:156], "        ")
+	sum := int64(0)
+	for _, c := range header {
+		sum += int64(c)
+	}
+	writeOctal(header[148:155], sum)
+}
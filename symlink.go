@@ -1,33 +1,30 @@
 package tarfs
 
 import (
-	"archive/tar"
 	"io"
 	"io/fs"
-	"path"
 	"strings"
 	"sync"
 )
 
-type symlink struct{ header *tar.Header }
-
-func (ln symlink) open(fileSystem *fileSystem) (fs.File, error) {
-	f := &openSymlink{header: ln.header}
-	f.reader.Reset(ln.header.Linkname)
-	return f, nil
+type symlink struct {
+	meta
+	linkname string
 }
 
-func (ln symlink) stat() fs.FileInfo {
-	return ln.header.FileInfo()
+func (ln *symlink) open(n *node) (fs.File, error) {
+	f := &openSymlink{info: ln.stat(n)}
+	f.reader.Reset(ln.linkname)
+	return f, nil
 }
 
-func (ln symlink) target() string {
-	return path.Join(path.Dir(ln.header.Name), ln.header.Linkname)
+func (ln *symlink) stat(n *node) fs.FileInfo {
+	return fileInfo{node: n, meta: &ln.meta, size: ln.size}
 }
 
 type openSymlink struct {
 	mutex  sync.RWMutex
-	header *tar.Header
+	info   fs.FileInfo
 	reader strings.Reader
 }
 
@@ -57,7 +54,7 @@ func (f *openSymlink) Close() error {
 }
 
 func (f *openSymlink) Stat() (fs.FileInfo, error) {
-	return f.header.FileInfo(), nil
+	return f.info, nil
 }
 
 var (
@@ -6,6 +6,7 @@ import (
 	"io"
 	"io/fs"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/stealthrocket/fslink"
@@ -13,82 +14,601 @@ import (
 
 var (
 	ErrLoop = errors.New("tarfs: loop detected while following symbolic links")
+	// ErrEscape is returned when following a symbolic link which leads out of
+	// the file system, when symbolic links are confined with the
+	// RefuseEscapingSymlinks option.
+	ErrEscape = errors.New("tarfs: symbolic link escapes the root of the file system")
+
+	// The following errors are the reasons reported by *EntryError when
+	// opening tarballs in strict mode.
+	ErrUnsafePath      = errors.New("tarfs: entry name is absolute or references parent directories")
+	ErrUnsupportedType = errors.New("tarfs: unsupported entry type")
+	ErrNotDir          = errors.New("tarfs: parent of entry is not a directory")
+	ErrDanglingLink    = errors.New("tarfs: hard link target does not exist")
+	ErrLinkTarget      = errors.New("tarfs: hard link target is a directory")
 )
 
-func OpenFS(data io.ReaderAt, size int64) (fs.FS, error) {
-	modTime := time.Now()
-	section := io.NewSectionReader(data, 0, size)
-	reader := tar.NewReader(section)
-	links := []*link{}
-	files := map[string]fileEntry{
-		".": &dir{name: ".", modTime: modTime}, // root
+// OpenFS opens a file system from the tarball read from data, which is
+// expected to be size bytes long.
+//
+// The tarball may be compressed with gzip, in which case an index of the
+// compressed stream is built while scanning the archive so that reading files
+// only needs to decompress data from the nearest checkpoint preceding them.
+//
+// Directories which do not have an entry in the tarball but contain other
+// entries are created implicitly, the options can be used to configure their
+// permissions and modification time.
+//
+// By default, all the headers of the tarball are read before OpenFS returns,
+// the Lazy option can be used to defer the scan until entries are accessed.
+func OpenFS(data io.ReaderAt, size int64, options ...Option) (fs.FS, error) {
+	b := newBuilder(options)
+	if b.config.lazy {
+		return b.lazyFileSystem(data, size), nil
+	}
+	data, size, err := b.scan(data, size, false)
+	if err != nil {
+		return nil, err
 	}
+	return b.fileSystem(data, size), nil
+}
 
-	err := walk(reader, func(header *tar.Header) error {
-		var entry fileEntry
+// builder constructs the index of a file system from the entries of one or
+// more tarballs.
+type builder struct {
+	config  *config
+	limiter limiter
+	root    *node
+	names   map[string]string // interned names of the nodes
+	links   []*node
+	cache   *blockCache // nil if the BlockCache option is not used
+}
 
-		switch header.Typeflag {
-		case tar.TypeReg:
-			offset, _ := section.Seek(0, io.SeekCurrent)
-			entry = &file{header: header, offset: offset}
+type builderEntry struct {
+	name   string
+	entry  fileEntry
+	offset int64
+}
 
-		case tar.TypeDir:
-			entry = &dir{name: header.Name, modTime: modTime}
+func newBuilder(options []Option) *builder {
+	b := &builder{config: newConfig(options)}
+	b.limiter.limits = b.config.limits
+	b.root = &node{name: ".", entry: b.implicitDir()}
+	if b.config.cacheBlockSize > 0 {
+		b.cache = newBlockCache(b.config.cacheBlockSize, b.config.cacheCapacity)
+	}
+	return b
+}
 
-		case tar.TypeLink:
-			ln := &link{header: header}
-			entry = ln
-			links = append(links, ln)
+func (b *builder) implicitDir() *dir {
+	d := &dir{meta{mode: fs.ModeDir | b.config.implicitDirMode}}
+	d.setModTime(b.config.implicitDirModTime)
+	return d
+}
 
-		case tar.TypeSymlink:
-			entry = symlink{header}
+func (b *builder) fileSystem(data io.ReaderAt, size int64) *fileSystem {
+	b.root.forEach((*node).sortChildren)
+	if b.config.newestDirModTime {
+		b.newestModTime(b.root)
+	}
+	b.linkFiles()
+	b.names = nil
+	return &fileSystem{
+		config:      b.config,
+		data:        data,
+		size:        size,
+		root:        b.root,
+		maxSymlinks: b.limiter.maxSymlinks(),
+		cache:       b.cache,
+	}
+}
 
-		default:
-			entry = deny{header}
+// cached returns a reader of data going through the block cache, if any.
+func (b *builder) cached(data io.ReaderAt) io.ReaderAt {
+	if b.cache == nil {
+		return data
+	}
+	return b.cache.reader(data)
+}
+
+// scan adds the entries of the tarball read from data to the file system,
+// returning the reader and size of the uncompressed archive.
+//
+// When whiteouts is true, the tarball is treated as a layer applied on top of
+// the entries already in the file system, and whiteout files are interpreted
+// as deletions of entries from the lower layers.
+func (b *builder) scan(data io.ReaderAt, size int64, whiteouts bool) (io.ReaderAt, int64, error) {
+	s := b.newScanner(data, size, whiteouts)
+	for {
+		if err := s.next(); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, 0, err
 		}
+	}
+	if err := s.finish(); err != nil {
+		return nil, 0, err
+	}
 
-		makePath(files, header.Name, modTime)
-		files[header.Name] = entry
+	// Whiteouts only apply to the lower layers, they must be processed before
+	// adding the entries of this layer.
+	for _, name := range s.opaques {
+		if n := b.find(name); n != nil {
+			if _, ok := n.entry.(*dir); ok {
+				n.children, n.index = nil, nil
+			}
+		}
+	}
+	for _, name := range s.deletes {
+		if n := b.find(name); n != nil {
+			b.delete(n)
+		}
+	}
+	for _, e := range s.entries {
+		if err := s.add(e); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := s.resolveLinks(); err != nil {
+		return nil, 0, err
+	}
+	return s.data, s.size, nil
+}
+
+// scanner reads the entries of a tarball one header at a time.
+type scanner struct {
+	builder   *builder
+	input     io.ReadSeeker
+	index     *gzipIndexer
+	reader    *tar.Reader
+	data      io.ReaderAt
+	size      int64
+	end       int64 // offset of the end of the last entry
+	whiteouts bool
+	entries   []builderEntry
+	deletes   []string
+	opaques   []string
+	offsets   map[string]int64
+	parents   map[string]int64
+}
+
+func (b *builder) newScanner(data io.ReaderAt, size int64, whiteouts bool) *scanner {
+	s := &scanner{
+		builder:   b,
+		data:      data,
+		size:      size,
+		whiteouts: whiteouts,
+		entries:   []builderEntry{},
+		offsets:   make(map[string]int64),
+		parents:   make(map[string]int64),
+	}
+	if isGzip(data, size) {
+		s.index = newGzipIndexer(data, size)
+		s.input, s.data = s.index, b.cached(s.index.file)
+	} else {
+		s.data = b.cached(data)
+		s.input = io.NewSectionReader(s.data, 0, size)
+	}
+	s.reader = tar.NewReader(s.input)
+	return s
+}
+
+// next reads the next header of the tarball, and appends the entry that it
+// describes to s.entries, unless the header does not contribute an entry to
+// the file system (e.g. whiteouts or ignored duplicates). The method returns
+// io.EOF when the end of the tarball is reached.
+func (s *scanner) next() error {
+	// The headers of an entry start where the previous entry ends, which is
+	// where the complete header is decoded from when it is requested.
+	headerOffset := s.end
+	header, name, err := nextHeader(s.reader)
+	if err != nil {
+		return err
+	}
+
+	var entry fileEntry
+	// The reader is positioned right after the header of the entry.
+	offset, _ := s.input.Seek(0, io.SeekCurrent)
+	config := s.builder.config
+
+	var sparse []sparseEntry
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeGNUSparse:
+		if sparse, err = sparseMap(s.data, offset, header); err != nil {
+			return err
+		}
+	}
+	s.end = offset + dataSize(header, sparse)
+	s.end += (headerSize - s.end%headerSize) % headerSize
+
+	if err := s.builder.limiter.check(header); err != nil {
+		return err
+	}
+
+	if header.Typeflag == tar.TypeXGlobalHeader {
+		// The records of global headers apply to the following entries,
+		// the headers themselves are not entries of the file system.
 		return nil
-	})
+	}
+
+	if config.strict {
+		switch {
+		case !safePath(name):
+			return &EntryError{Name: name, Offset: headerOffset, Err: ErrUnsafePath}
+		case !supportedType(header.Typeflag):
+			return &EntryError{Name: header.Name, Offset: headerOffset, Err: ErrUnsupportedType}
+		}
+	}
+
+	if s.whiteouts {
+		dir, base := path.Dir(header.Name), path.Base(header.Name)
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			switch {
+			case base == whiteoutOpaque:
+				s.opaques = append(s.opaques, dir)
+			case strings.HasPrefix(base, whiteoutMeta):
+				// other AUFS metadata files are not part of the file system
+			default:
+				s.deletes = append(s.deletes, path.Join(dir, base[len(whiteoutPrefix):]))
+			}
+			return nil
+		}
+	}
+
+	// Directories implied by the names of previous entries only conflict
+	// with entries which are not directories.
+	prev, ok := s.offsets[header.Name]
+	if !ok && header.Typeflag != tar.TypeDir {
+		prev, ok = s.parents[header.Name]
+	}
+	if ok {
+		switch config.duplicates {
+		case FirstWins:
+			return nil
+		case RejectDuplicates:
+			return &DuplicateError{
+				Name:        header.Name,
+				FirstOffset: prev,
+				Offset:      headerOffset,
+			}
+		}
+	}
+	s.offsets[header.Name] = headerOffset
+	for dir := path.Dir(header.Name); dir != "."; dir = path.Dir(dir) {
+		if _, ok := s.parents[dir]; ok {
+			break
+		}
+		s.parents[dir] = headerOffset
+	}
+
+	m := makeMeta(s.data, headerOffset, header, header.FileInfo().Mode())
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeGNUSparse:
+		entry = &file{meta: m, offset: offset, sparse: sparse}
+
+	case tar.TypeDir:
+		m.size = 0
+		entry = &dir{m}
+
+	case tar.TypeLink:
+		entry = &link{meta: m, linkname: header.Linkname}
+
+	case tar.TypeSymlink:
+		entry = &symlink{meta: m, linkname: header.Linkname}
+
+	default:
+		m.mode = denyMode(header)
+		entry = &deny{m}
+	}
+
+	s.entries = append(s.entries, builderEntry{header.Name, entry, headerOffset})
+	return nil
+}
+
+// finish completes the index of gzip compressed tarballs once all the headers
+// were read, which gives the size of the uncompressed archive.
+func (s *scanner) finish() error {
+	// The offsets are only needed to detect duplicates while scanning, and
+	// retain the full path of every entry of the tarball.
+	s.offsets, s.parents = nil, nil
+	if s.index != nil {
+		if err := s.index.finish(); err != nil {
+			return err
+		}
+		s.size = s.index.file.length
+	}
+	return nil
+}
+
+// dataSize returns the number of bytes stored in the tarball after the header
+// of h, excluding the padding of the last block.
+func dataSize(h *tar.Header, sparse []sparseEntry) int64 {
+	switch h.Typeflag {
+	case tar.TypeLink, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeDir, tar.TypeFifo:
+		return 0
+	case tar.TypeXGlobalHeader:
+		return 0 // the records were read by the tar.Reader
+	}
+	if sparse != nil {
+		if len(sparse) == 0 {
+			return 0
+		}
+		last := sparse[len(sparse)-1]
+		return last.phys + last.length
+	}
+	return h.Size
+}
+
+// add adds e to the file system. Only limit errors are reported, unless the
+// file system is strict, in which case entries that cannot be added because
+// their parent is not a directory are reported as well.
+func (s *scanner) add(e builderEntry) error {
+	if err := s.builder.add(e.name, e.entry); err != nil {
+		if _, ok := err.(*LimitError); ok {
+			return err
+		}
+		if s.builder.config.strict {
+			return &EntryError{Name: e.name, Offset: e.offset, Err: ErrNotDir}
+		}
+	}
+	return nil
+}
+
+// resolveLinks resolves the hard links of the tarball, which in strict mode
+// must all be valid.
+func (s *scanner) resolveLinks() error {
+	n, err := s.builder.resolveLinks()
+	if err != nil && s.builder.config.strict {
+		for _, e := range s.entries {
+			if e.entry == n.entry {
+				return &EntryError{Name: e.name, Offset: e.offset, Err: err}
+			}
+		}
+	}
+	s.entries = nil
+	return nil
+}
+
+// add adds an entry to the file system, replacing any previous entry with the
+// same name. When a directory replaces another directory, it inherits its
+// entries, otherwise the previous entry and all its children are removed, which
+// matches the behavior of extracting the tarball with GNU tar.
+func (b *builder) add(name string, entry fileEntry) error {
+	parent, err := b.makePath(name)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	base := path.Base(name)
+	n := parent.child(base)
+	if n == nil {
+		if n, err = b.addChild(parent, base); err != nil {
+			return err
+		}
+	} else if _, ok := entry.(*dir); !ok {
+		n.children, n.index = nil, nil
 	}
+	if _, ok := entry.(*link); ok {
+		b.links = append(b.links, n)
+	}
+	n.entry = entry
+	return nil
+}
 
-	for _, ln := range links {
-		ln.target, _ = files[ln.header.Linkname].(*file)
+// addChild adds a node named name to the children of parent.
+func (b *builder) addChild(parent *node, name string) (*node, error) {
+	if parent.index == nil {
+		// The children were sorted when the file system was built, new
+		// entries are added to the index until it is built again.
+		parent.index = make(map[string]*node, len(parent.children)+1)
+		for _, child := range parent.children {
+			parent.index[child.name] = child
+		}
+		parent.children = nil
+	}
+	if max := b.config.limits.MaxDirEntries; max > 0 && len(parent.index) >= max {
+		return nil, &LimitError{Limit: "MaxDirEntries", Value: int64(max)}
 	}
+	n := &node{name: b.intern(name), parent: parent}
+	parent.index[n.name] = n
+	return n, nil
+}
 
-	fileSystem := &fileSystem{
-		data:  data,
-		size:  size,
-		files: files,
+// intern returns a copy of name shared by all the nodes with the same name,
+// which does not retain the memory of the tar header that name was taken from.
+func (b *builder) intern(name string) string {
+	if s, ok := b.names[name]; ok {
+		return s
+	}
+	if b.names == nil {
+		b.names = make(map[string]string)
+	}
+	s := strings.Clone(name)
+	b.names[s] = s
+	return s
+}
+
+// find returns the node of the entry named name, or nil if the entry does not
+// exist. Symbolic links are not followed.
+func (b *builder) find(name string) *node {
+	switch name {
+	case "":
+		return nil
+	case ".":
+		return b.root
+	}
+	n := b.root
+	for n != nil && name != "" {
+		var elem string
+		elem, name, _ = strings.Cut(name, "/")
+		n = n.child(elem)
+	}
+	return n
+}
+
+// delete removes a node and all its children from the file system.
+func (b *builder) delete(n *node) {
+	if n.parent != nil {
+		delete(n.parent.index, n.name)
+	}
+}
+
+// resolveLinks resolves the targets of hard links added since the last call,
+// returning the node of the first link which could not be resolved and the
+// reason why.
+//
+// Hard links to symbolic links and special files are replaced by their target,
+// so they behave like the entries they link to.
+func (b *builder) resolveLinks() (*node, error) {
+	var unresolved *node
+	var lastErr error
+
+	for _, n := range b.links {
+		if err := b.resolveLink(n); err != nil && unresolved == nil {
+			unresolved, lastErr = n, err
+		}
 	}
 
-	return fileSystem, nil
+	b.links = b.links[:0]
+	return unresolved, lastErr
 }
 
-func walk(r *tar.Reader, f func(*tar.Header) error) error {
+// resolveLink resolves the target of a single hard link, doing nothing if the
+// entry of n is not a hard link anymore.
+func (b *builder) resolveLink(n *node) error {
+	ln, ok := n.entry.(*link)
+	if !ok {
+		return nil
+	}
+	target, err := b.linkTarget(ln)
+	if err != nil {
+		return err
+	}
+
+	switch t := target.(type) {
+	case *file:
+		ln.target = t
+	case *symlink, *deny:
+		n.entry = t
+	}
+	return nil
+}
+
+// linkTarget follows the chain of hard links starting at ln, returning the
+// entry that the links resolve to.
+func (b *builder) linkTarget(ln *link) (fileEntry, error) {
+	seen := make(map[*link]struct{})
+
 	for {
-		h, err := r.Next()
+		if ln.target != nil {
+			return ln.target, nil
+		}
+		if _, loop := seen[ln]; loop {
+			return nil, ErrLoop
+		}
+		seen[ln] = struct{}{}
+
+		n := b.find(cleanLinkname(ln.linkname))
+		if n == nil {
+			return nil, ErrDanglingLink
+		}
+		switch entry := n.entry.(type) {
+		case *dir:
+			return nil, ErrLinkTarget
+		case *link:
+			ln = entry
+		default:
+			return entry, nil
+		}
+	}
+}
+
+func cleanLinkname(name string) string {
+	return strings.TrimPrefix(path.Join("/", name), "/")
+}
+
+// linkFiles assigns inode numbers to regular files, and counts the number of
+// entries referencing each of them. Inode numbers are assigned in the order of
+// the file system tree so they do not depend on the order of the tarball
+// entries.
+func (b *builder) linkFiles() {
+	ino := uint64(0)
+	b.root.forEach(func(n *node) {
+		var f *file
+		switch entry := n.entry.(type) {
+		case *file:
+			f = entry
+		case *link:
+			f = entry.target
+		}
+		if f != nil {
+			if f.ino == 0 {
+				ino++
+				f.ino = ino
+			}
+			f.nlink++
+		}
+	})
+}
+
+// walk calls f for each entry of the tarball. The name of the header passed to
+// f is cleaned, the original name is passed as second argument.
+func walk(r *tar.Reader, f func(*tar.Header, string) error) error {
+	for {
+		h, name, err := nextHeader(r)
 		if err != nil {
 			if err == io.EOF {
 				err = nil
 			}
 			return err
 		}
+		if err := f(h, name); err != nil {
+			return err
+		}
+	}
+}
+
+// nextHeader returns the next header of the tarball with a cleaned name, and
+// the original name of the entry.
+func nextHeader(r *tar.Reader) (*tar.Header, string, error) {
+	for {
+		h, err := r.Next()
+		if err != nil {
+			return nil, "", err
+		}
 
 		// ensure that no path will reference parent directories above the root
+		name := h.Name
 		h.Name = path.Join("/", h.Name)
 		if h.Name == "/" {
 			continue // don't allow overriding the root
 		}
 		h.Name = h.Name[1:] // strip leading "/"
+		return h, name, nil
+	}
+}
 
-		if err := f(h); err != nil {
-			return err
+// safePath returns true if name is a relative path which does not reference
+// parent directories.
+func safePath(name string) bool {
+	if strings.HasPrefix(name, "/") {
+		return false
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return false
 		}
 	}
+	return true
+}
+
+func supportedType(typeflag byte) bool {
+	switch typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse, tar.TypeDir, tar.TypeLink,
+		tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return true
+	}
+	return false
 }
 
 const (
@@ -96,44 +616,41 @@ const (
 )
 
 type fileSystem struct {
-	data  io.ReaderAt
-	size  int64
-	files map[string]fileEntry
+	config      *config
+	data        io.ReaderAt
+	size        int64
+	root        *node
+	maxSymlinks int
+	cache       *blockCache
 }
 
 type fileEntry interface {
-	open(*fileSystem) (fs.File, error)
-	stat() fs.FileInfo
+	open(*node) (fs.File, error)
+	stat(*node) fs.FileInfo
 }
 
 func (f *fileSystem) Open(name string) (fs.File, error) {
-	for i := 0; i < maxFollowSymlink; i++ {
-		entry, err := f.lookup(name)
-		if err != nil {
-			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
-		}
-		if s, ok := entry.(symlink); ok {
-			name = s.target()
-			continue
-		}
-		return entry.open(f)
+	n, err := f.lookup(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
 	}
-	return nil, ErrLoop
+	return n.entry.open(n)
 }
 
 func (f *fileSystem) Stat(name string) (fs.FileInfo, error) {
-	for i := 0; i < maxFollowSymlink; i++ {
-		entry, err := f.lookup(name)
-		if err != nil {
-			return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
-		}
-		if s, ok := entry.(symlink); ok {
-			name = s.target()
-			continue
-		}
-		return entry.stat(), nil
+	n, err := f.lookup(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
 	}
-	return nil, ErrLoop
+	return n.entry.stat(n), nil
+}
+
+func (f *fileSystem) Lstat(name string) (fs.FileInfo, error) {
+	n, err := f.lookup(name, false)
+	if err != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	return n.entry.stat(n), nil
 }
 
 func (f *fileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
@@ -152,63 +669,146 @@ func (f *fileSystem) ReadLink(name string) (string, error) {
 	return link, nil
 }
 
-func (f *fileSystem) lookup(name string) (fileEntry, error) {
+// lookup resolves name to an entry of the file system, following symbolic
+// links found in the intermediary path components, as well as in the last
+// component if follow is true. The function returns the node of the entry.
+//
+// Symbolic links are resolved as if the root of the file system was the root
+// of a chroot: relative targets are resolved from the directory that contains
+// the link, absolute targets from the root of the file system, and ".."
+// components never go above the root, unless the file system was configured
+// to refuse escaping symbolic links, in which case ErrEscape is returned when a
+// ".." component refers to the parent of the root.
+func (f *fileSystem) lookup(name string, follow bool) (*node, error) {
 	if !fs.ValidPath(name) {
 		return nil, fs.ErrInvalid
 	}
-	entry, ok := f.files[name]
-	if !ok {
-		return nil, fs.ErrNotExist
+
+	n := f.root
+	links := 0
+
+	for name != "" {
+		if _, ok := n.entry.(*dir); !ok {
+			return nil, fs.ErrNotExist
+		}
+
+		var elem string
+		elem, name, _ = strings.Cut(name, "/")
+
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if n.parent != nil {
+				n = n.parent
+			} else if f.config.refuseEscapingSymlinks {
+				return nil, ErrEscape
+			}
+			continue
+		}
+
+		next := n.child(elem)
+		if next == nil {
+			return nil, fs.ErrNotExist
+		}
+
+		if s, ok := next.entry.(*symlink); ok && (name != "" || follow) {
+			if links++; links > f.maxSymlinks {
+				return nil, ErrLoop
+			}
+			link := s.linkname
+			if link == "" {
+				return nil, fs.ErrNotExist
+			}
+			if name == "" {
+				name = link
+			} else {
+				name = link + "/" + name
+			}
+			if strings.HasPrefix(link, "/") {
+				n = f.root
+			}
+			continue
+		}
+
+		n = next
 	}
-	return entry, nil
+
+	return n, nil
 }
 
 func (f *fileSystem) readDir(name string) ([]fs.DirEntry, error) {
-	entry, err := f.lookup(name)
+	n, err := f.lookup(name, true)
 	if err != nil {
 		return nil, err
 	}
-	d, ok := entry.(*dir)
+	d, ok := n.entry.(*dir)
 	if !ok {
 		return nil, fs.ErrPermission
 	}
-	return d.readDir(f)
+	return d.readDir(n)
 }
 
 func (f *fileSystem) readLink(name string) (string, error) {
-	entry, err := f.lookup(name)
+	n, err := f.lookup(name, false)
 	if err != nil {
 		return "", err
 	}
-	s, ok := entry.(symlink)
+	s, ok := n.entry.(*symlink)
 	if !ok {
 		return "", fs.ErrInvalid
 	}
-	return s.header.Linkname, nil
+	return s.linkname, nil
 }
 
-func makePath(files map[string]fileEntry, name string, modTime time.Time) error {
-	var d *dir
-
-	dirname := path.Dir(name)
-	switch f := files[dirname].(type) {
-	case nil:
-		if err := makePath(files, dirname, modTime); err != nil {
-			return err
+// newestModTime sets the modification time of implicit directories to the most
+// recent modification time of their entries, returning the modification time
+// of the directory of n.
+func (b *builder) newestModTime(n *node) time.Time {
+	var modTime time.Time
+	for _, child := range n.children {
+		var t time.Time
+		switch child.entry.(type) {
+		case *dir:
+			t = b.newestModTime(child)
+		default:
+			t = child.entry.stat(child).ModTime()
 		}
-		d = &dir{name: dirname, modTime: modTime}
-		files[dirname] = d
-	case *dir:
-		d = f
-	default:
-		return fs.ErrPermission
+		if t.After(modTime) {
+			modTime = t
+		}
+	}
+	d := n.entry.(*dir)
+	if d.implicit() {
+		if modTime.IsZero() {
+			modTime = b.config.implicitDirModTime
+		}
+		d.setModTime(modTime)
 	}
+	return d.modTime()
+}
 
-	if d.entries == nil {
-		d.entries = make(map[string]struct{})
+// makePath returns the node of the parent directory of name, creating the
+// implicit directories which do not exist yet.
+func (b *builder) makePath(name string) (*node, error) {
+	parent := b.root
+	for {
+		elem, rest, ok := strings.Cut(name, "/")
+		if !ok {
+			return parent, nil
+		}
+		n := parent.child(elem)
+		if n == nil {
+			var err error
+			if n, err = b.addChild(parent, elem); err != nil {
+				return nil, err
+			}
+			n.entry = b.implicitDir()
+		} else if _, ok := n.entry.(*dir); !ok {
+			return nil, fs.ErrPermission
+		}
+		parent, name = n, rest
 	}
-	d.entries[name] = struct{}{}
-	return nil
 }
 
 var (
@@ -3,12 +3,19 @@ package tarfs_test
 import (
 	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
+	"os"
+	"runtime"
+	"strings"
 	"testing"
 	"testing/fstest"
+	"time"
 
+	"github.com/stealthrocket/fslink"
 	"github.com/stealthrocket/tarfs"
 )
 
@@ -66,10 +73,685 @@ func TestTarFS(t *testing.T) {
 		fileSystem := openFS(t, buffer.Bytes())
 		assertPermissionDenied(t, fileSystem, "tmp/block")
 	})
+
+	t.Run("symbolic links in path", func(t *testing.T) {
+		buffer := bytes.NewBuffer(nil)
+		writer := tar.NewWriter(buffer)
+
+		writeFile(t, writer, "tmp/subtmp/one", "1", 0644)
+		writeFile(t, writer, "tmp/subtmp/two", "2", 0644)
+		writeSymlink(t, writer, "tmp/subtmp/link", "two")
+		writeSymlink(t, writer, "tmp/linkdir", "subtmp")
+		writeSymlink(t, writer, "tmp/linkdir2", "./linkdir/")
+		writeSymlink(t, writer, "tmp/parent", "linkdir/..")
+		writeSymlink(t, writer, "tmp/file", "subtmp/one")
+		closeArchive(t, writer)
+
+		fileSystem := openFS(t, buffer.Bytes())
+
+		assertReadFile(t, fileSystem, "tmp/linkdir/one", "1")
+		assertReadFile(t, fileSystem, "tmp/linkdir2/two", "2")
+		assertReadFile(t, fileSystem, "tmp/linkdir2/link", "2")
+		assertReadFile(t, fileSystem, "tmp/parent/subtmp/one", "1")
+		assertReadDir(t, fileSystem, "tmp/linkdir", "link", "one", "two")
+		assertReadDir(t, fileSystem, "tmp/parent", "file", "linkdir", "linkdir2", "parent", "subtmp")
+
+		assertReadLink(t, fileSystem, "tmp/linkdir", "subtmp")
+		assertReadLink(t, fileSystem, "tmp/linkdir2/link", "two")
+
+		for _, name := range []string{"tmp/file/one", "tmp/linkdir/three", "tmp/subtmp/one/two"} {
+			if _, err := fs.Stat(fileSystem, name); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("%s: error mismatch: want=%v got=%v", name, fs.ErrNotExist, err)
+			}
+		}
+	})
+
+	t.Run("symbolic link targets", func(t *testing.T) {
+		buffer := bytes.NewBuffer(nil)
+		writer := tar.NewWriter(buffer)
+
+		writeFile(t, writer, "etc/hosts", "127.0.0.1 localhost", 0644)
+		writeSymlink(t, writer, "lib/relative", "../etc/hosts")
+		writeSymlink(t, writer, "lib/absolute", "/etc/hosts")
+		writeSymlink(t, writer, "lib/escape", "../../../etc/hosts")
+		writeSymlink(t, writer, "lib/root", "/")
+		writeSymlink(t, writer, "lib/up", "../..")
+		writeSymlink(t, writer, "lib/above", "/..")
+		closeArchive(t, writer)
+
+		fileSystem := openFS(t, buffer.Bytes())
+		for _, name := range []string{
+			"lib/relative",
+			"lib/absolute",
+			"lib/escape",
+			"lib/root/etc/hosts",
+			"lib/up/etc/hosts",
+			"lib/up/lib/absolute",
+		} {
+			assertReadFile(t, fileSystem, name, "127.0.0.1 localhost")
+		}
+		assertReadDir(t, fileSystem, "lib/root", "etc", "lib")
+
+		confined := openFS(t, buffer.Bytes(), tarfs.RefuseEscapingSymlinks())
+		for _, name := range []string{"lib/relative", "lib/absolute", "lib/root/etc/hosts"} {
+			assertReadFile(t, confined, name, "127.0.0.1 localhost")
+		}
+
+		for _, name := range []string{"lib/escape", "lib/up", "lib/above/etc/hosts"} {
+			if _, err := fs.Stat(confined, name); !errors.Is(err, tarfs.ErrEscape) {
+				t.Errorf("%s: error mismatch: want=%v got=%v", name, tarfs.ErrEscape, err)
+			}
+		}
+	})
+
+	t.Run("symbolic link loops", func(t *testing.T) {
+		buffer := bytes.NewBuffer(nil)
+		writer := tar.NewWriter(buffer)
+
+		writeSymlink(t, writer, "loop/a", "b")
+		writeSymlink(t, writer, "loop/b", "a")
+		writeSymlink(t, writer, "loop/self", "self/x")
+		closeArchive(t, writer)
+
+		fileSystem := openFS(t, buffer.Bytes())
+
+		for _, name := range []string{"loop/a", "loop/b/c", "loop/self"} {
+			if _, err := fs.Stat(fileSystem, name); !errors.Is(err, tarfs.ErrLoop) {
+				t.Errorf("%s: error mismatch: want=%v got=%v", name, tarfs.ErrLoop, err)
+			}
+		}
+	})
+
+	t.Run("directory metadata", func(t *testing.T) {
+		buffer := bytes.NewBuffer(nil)
+		writer := tar.NewWriter(buffer)
+
+		modTime := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+		if err := writer.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     "home/user/",
+			Mode:     0700,
+			ModTime:  modTime,
+			Uid:      1000,
+			Uname:    "user",
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     "var/log/messages",
+			Mode:     0644,
+			ModTime:  modTime.Add(time.Hour),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		closeArchive(t, writer)
+
+		fileSystem := openFS(t, buffer.Bytes())
+		assertDirInfo(t, fileSystem, "home/user", 0700, modTime)
+		assertDirInfo(t, fileSystem, "home", 0755, time.Unix(0, 0))
+		assertDirInfo(t, fileSystem, ".", 0755, time.Unix(0, 0))
+
+		info, err := fs.Stat(fileSystem, "home/user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h, _ := info.Sys().(*tar.Header); h == nil || h.Uname != "user" || h.Uid != 1000 {
+			t.Errorf("home/user: missing owner information in %#v", info.Sys())
+		}
+
+		fileSystem = openFS(t, buffer.Bytes(),
+			tarfs.ImplicitDirMode(0750),
+			tarfs.ImplicitDirModTime(modTime),
+		)
+		assertDirInfo(t, fileSystem, "home/user", 0700, modTime)
+		assertDirInfo(t, fileSystem, "var/log", 0750, modTime)
+
+		fileSystem = openFS(t, buffer.Bytes(), tarfs.ImplicitDirNewestModTime())
+		assertDirInfo(t, fileSystem, "home/user", 0700, modTime)
+		assertDirInfo(t, fileSystem, "home", 0755, modTime)
+		assertDirInfo(t, fileSystem, "var/log", 0755, modTime.Add(time.Hour))
+		assertDirInfo(t, fileSystem, ".", 0755, modTime.Add(time.Hour))
+	})
+
+	t.Run("duplicate entries", func(t *testing.T) {
+		buffer := bytes.NewBuffer(nil)
+		writer := tar.NewWriter(buffer)
+
+		writeFile(t, writer, "file", "v1", 0644)
+		writeFile(t, writer, "file", "v2", 0644)
+		writeFile(t, writer, "a/b/c", "C", 0644)
+		writeFile(t, writer, "a", "A", 0644)
+		writeFile(t, writer, "d", "D", 0644)
+		writeDir(t, writer, "d")
+		writeFile(t, writer, "d/e", "E", 0644)
+		closeArchive(t, writer)
+
+		fileSystem := openFS(t, buffer.Bytes())
+		assertReadFile(t, fileSystem, "file", "v2")
+		assertReadFile(t, fileSystem, "a", "A")
+		assertReadFile(t, fileSystem, "d/e", "E")
+		assertReadDir(t, fileSystem, ".", "a", "d", "file")
+		for _, name := range []string{"a/b", "a/b/c"} {
+			if _, err := fs.Stat(fileSystem, name); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("%s: error mismatch: want=%v got=%v", name, fs.ErrNotExist, err)
+			}
+		}
+
+		fileSystem = openFS(t, buffer.Bytes(), tarfs.Duplicates(tarfs.FirstWins))
+		assertReadFile(t, fileSystem, "file", "v1")
+		assertReadFile(t, fileSystem, "a/b/c", "C")
+		assertReadFile(t, fileSystem, "d", "D")
+		assertReadDir(t, fileSystem, ".", "a", "d", "file")
+
+		_, err := tarfs.OpenFS(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()), tarfs.Duplicates(tarfs.RejectDuplicates))
+		var dup *tarfs.DuplicateError
+		if !errors.As(err, &dup) {
+			t.Fatalf("error mismatch: want=%T got=%v", dup, err)
+		}
+		if dup.Name != "file" || dup.FirstOffset != 0 || dup.Offset != 1024 {
+			t.Errorf("duplicate error mismatch: %+v", dup)
+		}
+	})
+
+	t.Run("strict mode", func(t *testing.T) {
+		for _, test := range []struct {
+			scenario string
+			write    func(*tar.Writer)
+			name     string
+			offset   int64
+			reason   error
+		}{
+			{
+				scenario: "parent directory",
+				write: func(w *tar.Writer) {
+					writeFile(t, w, "etc/hosts", "", 0644)
+					writeFile(t, w, "etc/../../passwd", "", 0644)
+				},
+				name:   "etc/../../passwd",
+				offset: 512,
+				reason: tarfs.ErrUnsafePath,
+			},
+			{
+				scenario: "extended headers",
+				write: func(w *tar.Writer) {
+					writeFile(t, w, "etc/hosts", "", 0644)
+					writeFile(t, w, "etc/"+strings.Repeat("../", 40)+"passwd", "", 0644)
+				},
+				name:   "etc/" + strings.Repeat("../", 40) + "passwd",
+				offset: 512,
+				reason: tarfs.ErrUnsafePath,
+			},
+			{
+				scenario: "absolute path",
+				write:    func(w *tar.Writer) { writeFile(t, w, "/etc/passwd", "", 0644) },
+				name:     "/etc/passwd",
+				reason:   tarfs.ErrUnsafePath,
+			},
+			{
+				scenario: "unsupported type",
+				write: func(w *tar.Writer) {
+					if err := w.WriteHeader(&tar.Header{Typeflag: 'V', Name: "volume"}); err != nil {
+						t.Fatal(err)
+					}
+				},
+				name:   "volume",
+				reason: tarfs.ErrUnsupportedType,
+			},
+			{
+				scenario: "file used as directory",
+				write: func(w *tar.Writer) {
+					writeFile(t, w, "etc", "", 0644)
+					writeFile(t, w, "etc/hosts", "", 0644)
+				},
+				name:   "etc/hosts",
+				offset: 512,
+				reason: tarfs.ErrNotDir,
+			},
+			{
+				scenario: "dangling hard link",
+				write:    func(w *tar.Writer) { writeLink(t, w, "hosts", "etc/hosts") },
+				name:     "hosts",
+				reason:   tarfs.ErrDanglingLink,
+			},
+			{
+				scenario: "hard link to directory",
+				write: func(w *tar.Writer) {
+					writeDir(t, w, "etc")
+					writeLink(t, w, "hosts", "etc")
+				},
+				name:   "hosts",
+				offset: 512,
+				reason: tarfs.ErrLinkTarget,
+			},
+		} {
+			t.Run(test.scenario, func(t *testing.T) {
+				buffer := bytes.NewBuffer(nil)
+				writer := tar.NewWriter(buffer)
+				test.write(writer)
+				closeArchive(t, writer)
+
+				openFS(t, buffer.Bytes())
+
+				_, err := tarfs.OpenFS(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()), tarfs.Strict())
+				var entryErr *tarfs.EntryError
+				if !errors.As(err, &entryErr) {
+					t.Fatalf("error mismatch: want=%T got=%v", entryErr, err)
+				}
+				if !errors.Is(err, test.reason) {
+					t.Errorf("reason mismatch: want=%v got=%v", test.reason, entryErr.Err)
+				}
+				if entryErr.Name != test.name || entryErr.Offset != test.offset {
+					t.Errorf("entry mismatch: want=%q@%d got=%q@%d", test.name, test.offset, entryErr.Name, entryErr.Offset)
+				}
+			})
+		}
+
+		t.Run("duplicate entries", func(t *testing.T) {
+			buffer := bytes.NewBuffer(nil)
+			writer := tar.NewWriter(buffer)
+			writeFile(t, writer, "etc/hosts", "", 0644)
+			writeFile(t, writer, "etc/hosts", "", 0644)
+			closeArchive(t, writer)
+
+			_, err := tarfs.OpenFS(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()), tarfs.Strict())
+			var dup *tarfs.DuplicateError
+			if !errors.As(err, &dup) {
+				t.Errorf("error mismatch: want=%T got=%v", dup, err)
+			}
+		})
+
+		t.Run("valid archive", func(t *testing.T) {
+			buffer := bytes.NewBuffer(nil)
+			writer := tar.NewWriter(buffer)
+			writeDir(t, writer, "./")
+			writeFile(t, writer, "./etc/hosts", "127.0.0.1 localhost", 0644)
+			writeLink(t, writer, "etc/hosts.bak", "etc/hosts")
+			writeSymlink(t, writer, "hosts", "../../etc/hosts")
+			writeDir(t, writer, "etc")
+			closeArchive(t, writer)
+
+			fileSystem := openFS(t, buffer.Bytes(), tarfs.Strict())
+			assertReadFile(t, fileSystem, "etc/hosts.bak", "127.0.0.1 localhost")
+			assertReadFile(t, fileSystem, "hosts", "127.0.0.1 localhost")
+		})
+	})
+
+	t.Run("resource limits", func(t *testing.T) {
+		buffer := bytes.NewBuffer(nil)
+		writer := tar.NewWriter(buffer)
+		writeFile(t, writer, "etc/hosts", "127.0.0.1 localhost", 0644)
+		writeFile(t, writer, "etc/passwd", "root:x:0:0", 0644)
+		writeSymlink(t, writer, "hosts", "etc/hosts")
+		writeSymlink(t, writer, "hosts.link", "hosts")
+		if err := writer.WriteHeader(&tar.Header{
+			Typeflag:   tar.TypeReg,
+			Name:       "bin/ping",
+			Format:     tar.FormatPAX,
+			PAXRecords: map[string]string{"SCHILY.xattr.security.capability": "cap_net_raw"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		closeArchive(t, writer)
+
+		for _, test := range []struct {
+			limits tarfs.Limits
+			limit  string
+		}{
+			{limits: tarfs.Limits{MaxEntries: 4}, limit: "MaxEntries"},
+			{limits: tarfs.Limits{MaxPathBytes: 40}, limit: "MaxPathBytes"},
+			{limits: tarfs.Limits{MaxPAXBytes: 32}, limit: "MaxPAXBytes"},
+			{limits: tarfs.Limits{MaxDirEntries: 1}, limit: "MaxDirEntries"},
+		} {
+			option := tarfs.ResourceLimits(test.limits)
+
+			_, err := tarfs.OpenFS(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()), option)
+			var limitErr *tarfs.LimitError
+			if !errors.As(err, &limitErr) || limitErr.Limit != test.limit {
+				t.Errorf("%s: open error mismatch: %v", test.limit, err)
+			}
+
+			err = tarfs.Extract(t.TempDir(), tar.NewReader(bytes.NewReader(buffer.Bytes())), option)
+			if !errors.As(err, &limitErr) || limitErr.Limit != test.limit {
+				t.Errorf("%s: extract error mismatch: %v", test.limit, err)
+			}
+		}
+
+		fileSystem := openFS(t, buffer.Bytes(), tarfs.ResourceLimits(tarfs.Limits{
+			MaxEntries:    5,
+			MaxPAXBytes:   64,
+			MaxDirEntries: 4,
+			MaxSymlinks:   1,
+		}))
+		assertReadFile(t, fileSystem, "hosts", "127.0.0.1 localhost")
+		if _, err := fs.Stat(fileSystem, "hosts.link"); !errors.Is(err, tarfs.ErrLoop) {
+			t.Errorf("error mismatch: want=%v got=%v", tarfs.ErrLoop, err)
+		}
+
+		t.Run("directory entries", func(t *testing.T) {
+			// Duplicates count once, and implicit directories count as
+			// entries of their parent, when opening and extracting.
+			buffer := bytes.NewBuffer(nil)
+			writer := tar.NewWriter(buffer)
+			writeFile(t, writer, "etc/hosts", "v1", 0644)
+			writeFile(t, writer, "etc/hosts", "v2", 0644)
+			writeFile(t, writer, "./etc/hosts", "v3", 0644)
+			writeFile(t, writer, "etc/passwd", "", 0644)
+			writeFile(t, writer, "bin/sh", "", 0755)
+			closeArchive(t, writer)
+
+			for _, test := range []struct {
+				max int
+				err bool
+			}{
+				{max: 1, err: true},
+				{max: 2, err: false},
+			} {
+				option := tarfs.ResourceLimits(tarfs.Limits{MaxDirEntries: test.max})
+
+				_, err := tarfs.OpenFS(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()), option)
+				if (err != nil) != test.err {
+					t.Errorf("MaxDirEntries=%d: open error mismatch: %v", test.max, err)
+				}
+
+				err = tarfs.Extract(t.TempDir(), tar.NewReader(bytes.NewReader(buffer.Bytes())), option)
+				if (err != nil) != test.err {
+					t.Errorf("MaxDirEntries=%d: extract error mismatch: %v", test.max, err)
+				}
+			}
+		})
+	})
+
+	t.Run("hard links", func(t *testing.T) {
+		buffer := bytes.NewBuffer(nil)
+		writer := tar.NewWriter(buffer)
+		writeLink(t, writer, "b", "a")
+		writeLink(t, writer, "c", "./b")
+		writeFile(t, writer, "a", "hello", 0644)
+		writeSymlink(t, writer, "s", "a")
+		writeLink(t, writer, "s2", "s")
+		writeBlock(t, writer, "dev/sda")
+		writeLink(t, writer, "sda", "dev/sda")
+		writeLink(t, writer, "x", "y")
+		writeLink(t, writer, "y", "x")
+		closeArchive(t, writer)
+
+		fileSystem := openFS(t, buffer.Bytes())
+		for _, name := range []string{"a", "b", "c", "s2"} {
+			assertReadFile(t, fileSystem, name, "hello")
+			info, err := fs.Stat(fileSystem, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != 5 {
+				t.Errorf("%s: size mismatch: want=5 got=%d", name, info.Size())
+			}
+		}
+		assertReadLink(t, fileSystem, "s2", "a")
+		assertPermissionDenied(t, fileSystem, "sda")
+
+		info, err := fs.Stat(fileSystem, "sda")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := tarfs.Header(info); h.Typeflag != tar.TypeBlock || h.Name != "sda" {
+			t.Errorf("sda: header mismatch: %+v", h)
+		}
+
+		for _, name := range []string{"x", "y"} {
+			if _, err := fs.ReadFile(fileSystem, name); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("%s: error mismatch: want=%v got=%v", name, fs.ErrNotExist, err)
+			}
+		}
+
+		_, err = tarfs.OpenFS(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()), tarfs.Strict())
+		var entryErr *tarfs.EntryError
+		if !errors.As(err, &entryErr) || !errors.Is(err, tarfs.ErrLoop) || entryErr.Name != "x" {
+			t.Errorf("error mismatch: want=%v got=%v", tarfs.ErrLoop, err)
+		}
+	})
+
+	t.Run("headers", func(t *testing.T) {
+		buffer := bytes.NewBuffer(nil)
+		writer := tar.NewWriter(buffer)
+
+		if err := writer.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     "bin/su",
+			Mode:     04755,
+			Uid:      0,
+			Gid:      42,
+			Uname:    "root",
+			Gname:    "shadow",
+			Format:   tar.FormatPAX,
+			PAXRecords: map[string]string{
+				"SCHILY.xattr.security.capability": "cap",
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeChar,
+			Name:     "dev/null",
+			Mode:     0666,
+			Devmajor: 1,
+			Devminor: 3,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		writeDir(t, writer, "etc")
+		writeLink(t, writer, "bin/sudo", "bin/su")
+		writeSymlink(t, writer, "bin/sh", "su")
+		closeArchive(t, writer)
+
+		fileSystem := openFS(t, buffer.Bytes())
+
+		for _, name := range []string{".", "bin", "bin/su", "bin/sudo", "dev/null", "etc"} {
+			info, err := fs.Stat(fileSystem, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Implicit and explicit directories are named the same way.
+			if h := tarfs.Header(info); h == nil {
+				t.Errorf("%s: missing tar header", name)
+			} else if h.Name != name {
+				t.Errorf("%s: header name mismatch: %q", name, h.Name)
+			}
+		}
+
+		info, err := fs.Stat(fileSystem, "bin/su")
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := tarfs.Header(info)
+		if h.Gid != 42 || h.Uname != "root" || h.Gname != "shadow" || h.Mode&04000 == 0 {
+			t.Errorf("bin/su: header mismatch: %+v", h)
+		}
+		if h.Xattrs["security.capability"] != "cap" {
+			t.Errorf("bin/su: extended attributes mismatch: %q", h.Xattrs)
+		}
+
+		info, err = fs.Stat(fileSystem, "dev/null")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := tarfs.Header(info); h.Devmajor != 1 || h.Devminor != 3 {
+			t.Errorf("dev/null: device mismatch: %d,%d", h.Devmajor, h.Devminor)
+		}
+
+		entries, err := fs.ReadDir(fileSystem, "bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h := tarfs.Header(info); h == nil || h.Name != "bin/"+entry.Name() {
+				t.Errorf("%s: header mismatch: %+v", entry.Name(), h)
+			}
+		}
+
+		info, err = fs.Stat(os.DirFS(t.TempDir()), ".")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := tarfs.Header(info); h != nil {
+			t.Errorf("unexpected tar header for local directory: %+v", h)
+		}
+	})
+
+	t.Run("headers read from the tarball", func(t *testing.T) {
+		longName := strings.Repeat("long/", 30) + "name"
+
+		buffer := bytes.NewBuffer(nil)
+		writer := tar.NewWriter(buffer)
+		if err := writer.WriteHeader(&tar.Header{
+			Typeflag:   tar.TypeXGlobalHeader,
+			Name:       "pax_global_header",
+			PAXRecords: map[string]string{"comment": "global"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		for _, h := range []*tar.Header{
+			{Typeflag: tar.TypeReg, Name: "global", Mode: 0644, Uname: "a"},
+			{Typeflag: tar.TypeReg, Name: longName, Mode: 0644, Uname: "b", Format: tar.FormatGNU},
+			{Typeflag: tar.TypeReg, Name: "pax", Mode: 0644, Uname: "c", PAXRecords: map[string]string{"comment": "pax"}},
+		} {
+			if err := writer.WriteHeader(h); err != nil {
+				t.Fatal(err)
+			}
+		}
+		writeSparse1x0(t, writer, buffer, "sparse", 4096, []fragment{{1000, "sparse"}})
+		if err := writer.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "last", Mode: 0644, Uname: "d", Size: 4}); err != nil {
+			t.Fatal(err)
+		}
+		writer.Write([]byte("last"))
+		closeArchive(t, writer)
+
+		for _, test := range []struct {
+			scenario string
+			data     []byte
+		}{
+			{scenario: "tar", data: buffer.Bytes()},
+			{scenario: "tar.gz", data: compress(t, buffer.Bytes(), gzip.BestSpeed, 1)},
+		} {
+			t.Run(test.scenario, func(t *testing.T) {
+				fileSystem := openFS(t, test.data)
+				index := writeIndex(t, fileSystem)
+				indexed, err := tarfs.OpenFSWithIndex(bytes.NewReader(test.data), int64(len(test.data)), bytes.NewReader(index))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for _, f := range []fs.FS{fileSystem, indexed} {
+					for name, uname := range map[string]string{
+						"global": "a",
+						longName: "b",
+						"pax":    "c",
+						"last":   "d",
+					} {
+						info, err := fs.Stat(f, name)
+						if err != nil {
+							t.Fatal(err)
+						}
+						if h := tarfs.Header(info); h == nil || h.Name != name || h.Uname != uname {
+							t.Errorf("%s: header mismatch: %+v", name, h)
+						}
+					}
+
+					info, err := fs.Stat(f, "sparse")
+					if err != nil {
+						t.Fatal(err)
+					}
+					if h := tarfs.Header(info); h == nil || h.Name != "sparse" || h.Size != 4096 {
+						t.Errorf("sparse: header mismatch: %+v", h)
+					}
+					assertReadFile(t, f, "last", "last")
+					assertReadDir(t, f, ".", "global", "last", "long", "pax", "sparse")
+				}
+
+				strict, err := tarfs.OpenFS(bytes.NewReader(test.data), int64(len(test.data)), tarfs.Strict())
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertReadDir(t, strict, ".", "global", "last", "long", "pax", "sparse")
+			})
+		}
+	})
+
+	t.Run("special files", func(t *testing.T) {
+		buffer := bytes.NewBuffer(nil)
+		writer := tar.NewWriter(buffer)
+
+		for _, h := range []*tar.Header{
+			{Typeflag: tar.TypeFifo, Name: "run/fifo", Mode: 0600},
+			{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0666, Devmajor: 1, Devminor: 3},
+			{Typeflag: tar.TypeBlock, Name: "dev/sda", Mode: 0660, Devmajor: 8, Devminor: 0},
+			{Typeflag: tar.TypeChar, Name: "dev/tty", Mode: 040620, Devmajor: 5, Devminor: 0},
+			{Typeflag: 'V', Name: "volume", Mode: 0644},
+		} {
+			if err := writer.WriteHeader(h); err != nil {
+				t.Fatal(err)
+			}
+		}
+		closeArchive(t, writer)
+
+		fileSystem := openFS(t, buffer.Bytes())
+		for name, mode := range map[string]fs.FileMode{
+			"run/fifo": fs.ModeNamedPipe | 0600,
+			"dev/null": fs.ModeDevice | fs.ModeCharDevice | 0666,
+			"dev/sda":  fs.ModeDevice | 0660,
+			"dev/tty":  fs.ModeDevice | fs.ModeCharDevice | 0620,
+			"volume":   fs.ModeIrregular | 0644,
+		} {
+			info, err := fs.Stat(fileSystem, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode() != mode || info.IsDir() {
+				t.Errorf("%s: mode mismatch: want=%v got=%v", name, mode, info.Mode())
+			}
+			assertPermissionDenied(t, fileSystem, name)
+		}
+
+		entries, err := fs.ReadDir(fileSystem, "dev")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || entry.Type()&fs.ModeDevice == 0 {
+				t.Errorf("%s: type mismatch: %v", entry.Name(), entry.Type())
+			}
+		}
+
+		info, err := fs.Stat(fileSystem, "dev/sda")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := tarfs.Header(info); h.Devmajor != 8 || h.Devminor != 0 {
+			t.Errorf("dev/sda: device mismatch: %d,%d", h.Devmajor, h.Devminor)
+		}
+	})
 }
 
-func openFS(t *testing.T, data []byte) fs.FS {
-	fileSystem, err := tarfs.OpenFS(bytes.NewReader(data), int64(len(data)))
+func assertDirInfo(t *testing.T, f fs.FS, name string, perm fs.FileMode, modTime time.Time) {
+	t.Helper()
+	info, err := fs.Stat(f, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode(); mode != fs.ModeDir|perm {
+		t.Errorf("%s: mode mismatch: want=%v got=%v", name, fs.ModeDir|perm, mode)
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("%s: modification time mismatch: want=%v got=%v", name, modTime, info.ModTime())
+	}
+}
+
+func openFS(t *testing.T, data []byte, options ...tarfs.Option) fs.FS {
+	fileSystem, err := tarfs.OpenFS(bytes.NewReader(data), int64(len(data)), options...)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -85,6 +767,16 @@ func assertReadFile(t *testing.T, f fs.FS, name, content string) {
 	}
 }
 
+func assertReadLink(t *testing.T, f fs.FS, name, link string) {
+	t.Helper()
+	s, err := fslink.ReadLink(f, name)
+	if err != nil {
+		t.Error(err)
+	} else if s != link {
+		t.Errorf("symbolic link %s mismatch: got=%q want=%q", name, s, link)
+	}
+}
+
 func assertPermissionDenied(t *testing.T, f fs.FS, name string) {
 	_, err := fs.ReadFile(f, name)
 	if !errors.Is(err, fs.ErrPermission) {
@@ -160,3 +852,82 @@ func closeArchive(t *testing.T, w *tar.Writer) {
 		t.Fatal(err)
 	}
 }
+
+// BenchmarkOpenFS measures the time to index a tarball and the memory retained
+// by the file system for each of its entries.
+func BenchmarkOpenFS(b *testing.B) {
+	const numDirs, numFiles = 1000, 100
+	archive := benchmarkArchive(b, numDirs, numFiles)
+	numEntries := numDirs * (numFiles + 1)
+
+	var fileSystem fs.FS
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		f, err := tarfs.OpenFS(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		fileSystem = f
+	}
+
+	b.StopTimer()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/float64(numEntries), "bytes/entry")
+	runtime.KeepAlive(fileSystem)
+}
+
+func BenchmarkReadDir(b *testing.B) {
+	const numFiles = 10000
+	archive := benchmarkArchive(b, 1, numFiles)
+	fileSystem, err := tarfs.OpenFS(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		entries, err := fs.ReadDir(fileSystem, "dir-0")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(entries) != numFiles {
+			b.Fatalf("wrong number of entries: %d", len(entries))
+		}
+	}
+}
+
+// benchmarkArchive returns a tarball of numDirs directories containing numFiles
+// empty files each, the names of the files are repeated in all directories.
+func benchmarkArchive(b *testing.B, numDirs, numFiles int) []byte {
+	buffer := bytes.NewBuffer(nil)
+	writer := tar.NewWriter(buffer)
+	for i := 0; i < numDirs; i++ {
+		if err := writer.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     fmt.Sprintf("dir-%d/", i),
+			Mode:     0755,
+		}); err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < numFiles; j++ {
+			if err := writer.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     fmt.Sprintf("dir-%d/file-%d", i, j),
+				Mode:     0644,
+				Uname:    "user",
+				Gname:    "user",
+			}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	if err := writer.Close(); err != nil {
+		b.Fatal(err)
+	}
+	return buffer.Bytes()
+}